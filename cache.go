@@ -0,0 +1,130 @@
+package sigmo
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+)
+
+// Version identifies the interpreter, and with the revision it was built
+// from, keeps it from reading imports cached by any other.
+var Version = "0.1"
+
+// CacheDir is where the parsed forms of imported files are cached, or ""
+// to parse them every time.
+var CacheDir = defaultCacheDir()
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sigmo")
+}
+
+var cacheVersion = buildVersion()
+
+func buildVersion() string {
+	v := imageMagic + Version
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" || s.Key == "vcs.modified" {
+				v += " " + s.Value
+			}
+		}
+	}
+	return v
+}
+
+// cachedForms is how the forms parsed from a file are cached, as an image of
+// them alone.
+type cachedForms struct {
+	Forms  []int
+	Values []imageValue
+}
+
+// cachePath returns the file the forms parsed from src are cached in, which
+// depends on the file name too since it is part of their positions.
+func cachePath(file string, src []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", cacheVersion, file)
+	h.Write(src)
+	return filepath.Join(CacheDir, hex.EncodeToString(h.Sum(nil))+".forms")
+}
+
+// readImport returns the forms in an imported file, from the cache if it
+// has been parsed before.
+func readImport(file string) ([]Value, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if CacheDir == "" {
+		return ParseFile(file, string(data))
+	}
+	path := cachePath(file, data)
+	if nodes, err := readCache(path); err == nil {
+		return nodes, nil
+	}
+	nodes, err := ParseFile(file, string(data))
+	if err != nil {
+		return nil, err
+	}
+	// the cache only saves time, so failing to write it isn't an error
+	writeCache(path, nodes)
+	return nodes, nil
+}
+
+func readCache(path string) ([]Value, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cached cachedForms
+	if err := gob.NewDecoder(f).Decode(&cached); err != nil {
+		return nil, err
+	}
+	r := &imageReader{values: cached.Values, decoded: make(map[int]Value)}
+	return r.list(cached.Forms)
+}
+
+func writeCache(path string, nodes []Value) error {
+	w := &imageWriter{values: []imageValue{{}}, seen: make(map[interface{}]int)}
+	forms, err := w.list(nodes)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(CacheDir, 0755); err != nil {
+		return err
+	}
+	// written alongside and renamed, so a partly written file is never read
+	f, err := ioutil.TempFile(CacheDir, "tmp-")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(cachedForms{Forms: forms, Values: w.values})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// CleanCache removes every file in CacheDir.
+func CleanCache() error {
+	if CacheDir == "" {
+		return nil
+	}
+	return os.RemoveAll(CacheDir)
+}
@@ -0,0 +1,123 @@
+package sigmo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sigmo-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prev := CacheDir
+	CacheDir = filepath.Join(dir, "cache")
+	defer func() { CacheDir = prev }()
+
+	file := filepath.Join(dir, "lib.mo")
+	write := func(src string) []byte {
+		if err := ioutil.WriteFile(file, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return []byte(src)
+	}
+	read := func() string {
+		t.Helper()
+		nodes, err := readImport(file)
+		if err != nil {
+			t.Fatalf("reading import: %v", err)
+		}
+		out := ""
+		for _, n := range nodes {
+			out += n.String()
+		}
+		return out
+	}
+
+	src := write(`(def x 1)`)
+	if got := read(); got != "(def x 1)" {
+		t.Fatalf("first read = %s, want (def x 1)", got)
+	}
+	path := cachePath(file, src)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("forms were not cached: %v", err)
+	}
+
+	// a hit is read from the cache without parsing the file again
+	forms, err := ParseFile(file, `(def x "cached")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCache(path, forms); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); got != `(def x "cached")` {
+		t.Errorf("cache hit = %s, want the cached forms", got)
+	}
+
+	// changing the file misses the cache
+	write(`(def x 2)`)
+	if got := read(); got != "(def x 2)" {
+		t.Errorf("read after change = %s, want (def x 2)", got)
+	}
+
+	// an unreadable cache entry is parsed again and replaced
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	write(`(def x 1)`)
+	if got := read(); got != "(def x 1)" {
+		t.Errorf("read with corrupt cache = %s, want (def x 1)", got)
+	}
+	if _, err := readCache(path); err != nil {
+		t.Errorf("corrupt cache entry was not replaced: %v", err)
+	}
+
+	// the file name is part of the key, since it is in the forms' positions
+	if cachePath(file, src) == cachePath(file+"2", src) {
+		t.Errorf("files with the same contents share a cache entry")
+	}
+	nodes, err := readImport(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := nodes[0].(*List).pos; p.File != file || p.Line != 1 {
+		t.Errorf("cached form is at %s, want %s:1", p, file)
+	}
+
+	// imports use the cache, and a missing file is an error
+	c := NewContext(nil)
+	evalString(t, c, `(import "`+file+`")`)
+	if got := c.Get("x").String(); got != "1" {
+		t.Errorf("imported x = %s, want 1", got)
+	}
+	if _, err := readImport(filepath.Join(dir, "missing.mo")); err == nil {
+		t.Errorf("reading a missing import: no error")
+	}
+}
+
+func TestImportWithoutCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sigmo-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prev := CacheDir
+	CacheDir = ""
+	defer func() { CacheDir = prev }()
+	file := filepath.Join(dir, "lib.mo")
+	if err := ioutil.WriteFile(file, []byte(`(def y 3)`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := readImport(file)
+	if err != nil || len(nodes) != 1 {
+		t.Fatalf("reading import = %v, %v", nodes, err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("cache written with CacheDir unset: %d files", len(files))
+	}
+}
@@ -0,0 +1,859 @@
+package sigmo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type CheckError struct {
+	// Pos is where the form is, or the list it is in for atoms, which
+	// don't record their positions
+	Pos  Pos
+	Form string
+	Msg  string
+}
+
+func (e CheckError) Error() string {
+	form := e.Form
+	if len(form) > 40 {
+		form = form[:37] + "..."
+	}
+	return fmt.Sprintf("%s: %s", form, e.Msg)
+}
+
+type checkSig struct {
+	name     string
+	params   []string
+	required int
+	keywords map[string]bool
+	rest     bool
+	types    string
+	ret      string
+}
+
+type checkValue struct {
+	t     string
+	sig   *checkSig
+	macro *List
+}
+
+var anyValue = checkValue{t: "*"}
+
+type checkScope struct {
+	parent *checkScope
+	ns     string
+	vars   map[string]checkValue
+}
+
+func newCheckScope(parent *checkScope) *checkScope {
+	s := &checkScope{parent: parent, vars: make(map[string]checkValue)}
+	if parent != nil {
+		s.ns = parent.ns
+	}
+	return s
+}
+
+func (s *checkScope) lookup(name string) (checkValue, bool) {
+	for x := s; x != nil; x = x.parent {
+		if v, ok := x.vars[name]; ok {
+			return v, true
+		}
+	}
+	return anyValue, false
+}
+
+func (s *checkScope) root() *checkScope {
+	x := s
+	for x.parent != nil {
+		x = x.parent
+	}
+	return x
+}
+
+type pendingIdent struct {
+	name  string
+	scope *checkScope
+	form  Value
+	pos   Pos
+}
+
+type checker struct {
+	errs     []error
+	pending  []pendingIdent
+	imported map[string]bool
+	lambdas  int
+	depth    int
+	// at is the position of the innermost list being checked
+	at Pos
+	// dir is what relative import paths are found from, or "" for the
+	// working directory
+	dir string
+}
+
+type checkForm func(*checker, *List, *checkScope) checkValue
+
+var checkForms map[string]checkForm
+
+// Check infers types through the given top-level forms without evaluating
+// them, and reports type mismatches, wrong arity and unknown identifiers.
+func Check(nodes []Value) []error {
+	return checkIn("", nodes)
+}
+
+// checkIn is Check with relative imports found from dir.
+func checkIn(dir string, nodes []Value) []error {
+	k := &checker{imported: make(map[string]bool), dir: dir}
+	root := newCheckScope(nil)
+	for name, fn := range builtins {
+		root.vars[name] = checkValue{t: "function", sig: builtinSig(name, fn)}
+	}
+	for name, a := range aliases {
+		root.vars[name] = root.vars[a]
+	}
+	k.checkAll(nodes, root)
+	return k.errs
+}
+
+func builtinSig(name string, fn Function) *checkSig {
+	ret := fn.ret
+	if ret == "" {
+		ret = "*"
+	}
+	return &checkSig{name: name, types: fn.types, ret: ret}
+}
+
+func (k *checker) errorf(form Value, format string, args ...interface{}) {
+	k.errorAt(k.at, form, format, args...)
+}
+
+func (k *checker) errorAt(pos Pos, form Value, format string, args ...interface{}) {
+	if l, ok := form.(*List); ok && l.pos.IsValid() {
+		pos = l.pos
+	}
+	k.errs = append(k.errs, CheckError{Pos: pos, Form: form.String(), Msg: fmt.Sprintf(format, args...)})
+}
+
+func (k *checker) checkAll(nodes []Value, s *checkScope) checkValue {
+	pending := k.pending
+	k.pending = nil
+	last := checkValue{t: "nil"}
+	for _, n := range nodes {
+		last = k.check(n, s)
+	}
+	// identifiers used inside function bodies may be defined after the
+	// function itself, so they are only reported once the file is done
+	for _, p := range k.pending {
+		if _, ok := p.scope.lookup(p.name); !ok {
+			k.errorAt(p.pos, p.form, "Unknown identifier '%s'", p.name)
+		}
+	}
+	k.pending = pending
+	return last
+}
+
+func (k *checker) lookup(n Value, s *checkScope) checkValue {
+	name := n.Value().(string)
+	if v, ok := s.lookup(name); ok {
+		return v
+	}
+	if k.lambdas > 0 {
+		k.pending = append(k.pending, pendingIdent{name: name, scope: s, form: n, pos: k.at})
+	} else {
+		k.errorf(n, "Unknown identifier '%s'", name)
+	}
+	return anyValue
+}
+
+func (k *checker) define(name string, v checkValue, s *checkScope) {
+	s.vars[name] = v
+	if s.ns != "" && s.parent != nil && s.parent.parent == nil {
+		s.root().vars[strings.TrimPrefix(s.ns, "/")+"/"+name] = v
+	}
+}
+
+func (k *checker) check(n Value, s *checkScope) checkValue {
+	switch n.Type() {
+	case "identifier":
+		return k.lookup(n, s)
+	case "expansion":
+		k.lookup(n, s)
+		return anyValue
+	case "hash":
+		for _, p := range n.(*Hash).pairs {
+			k.check(p, s)
+		}
+		return checkValue{t: "hash"}
+	case "list":
+		return k.checkList(n.(*List), s)
+	}
+	return checkValue{t: n.Type()}
+}
+
+func (k *checker) checkList(l *List, s *checkScope) checkValue {
+	if l.Quoted || len(l.children) == 0 {
+		return checkValue{t: "list"}
+	}
+	if l.pos.IsValid() {
+		defer func(at Pos) { k.at = at }(k.at)
+		k.at = l.pos
+	}
+	head := l.children[0]
+	if head.Type() == "identifier" {
+		if f, ok := checkForms[head.Value().(string)]; ok {
+			return f(k, l, s)
+		}
+		if _, ok := s.lookup(head.Value().(string)); !ok {
+			// the arguments of an unknown macro are not necessarily code
+			return k.lookup(head, s)
+		}
+	}
+	fn := k.check(head, s)
+	if fn.macro != nil {
+		return k.expand(fn.macro, l, s)
+	}
+	args := []string{}
+	expanded := false
+	for _, a := range l.children[1:] {
+		if a.Type() == "expansion" {
+			expanded = true
+		}
+		args = append(args, k.check(a, s).t)
+	}
+	switch fn.t {
+	case "function":
+		if fn.sig == nil {
+			return anyValue
+		}
+		if !expanded {
+			k.checkCall(fn.sig, args, l, s)
+		}
+		return checkValue{t: fn.sig.ret}
+	case "generic", "*":
+		return anyValue
+	}
+	return checkValue{t: "list"}
+}
+
+func (k *checker) checkCall(sig *checkSig, args []string, form *List, s *checkScope) {
+	if sig.types != "" {
+		k.checkBuiltinCall(sig, args, form)
+		return
+	}
+	if len(sig.keywords) > 0 {
+		positional := []string{}
+		for i := 0; i < len(args); i++ {
+			a := form.children[i+1]
+			if a.Type() == "symbol" && sig.keywords[a.Value().(string)] && i+1 < len(args) {
+				i++
+				continue
+			}
+			positional = append(positional, args[i])
+		}
+		args = positional
+	}
+	if len(args) < sig.required || (!sig.rest && len(args) > len(sig.params)) {
+		arity := fmt.Sprintf("%d", sig.required)
+		if sig.rest {
+			arity = fmt.Sprintf("at least %d", sig.required)
+		} else if sig.required != len(sig.params) {
+			arity = fmt.Sprintf("%d to %d", sig.required, len(sig.params))
+		}
+		k.errorf(form, "Function '%s' expected %s args, got %d", sig.name, arity, len(args))
+		return
+	}
+	for i, t := range sig.params {
+		if i >= len(args) {
+			break
+		}
+		if t == "*" || typeOverlaps(args[i], t) {
+			continue
+		}
+		// mismatched typed ids are passed through a conversion function of
+		// the same name when one exists
+		if conv, ok := s.lookup(t); ok && conv.t == "function" {
+			continue
+		}
+		k.errorf(form, "Function '%s' expected argument %d of type '%s', got '%s'", sig.name, i, t, args[i])
+	}
+}
+
+// checkBuiltinCall mirrors the argument checks done by the wrapper that
+// NewFunction builds around builtins.
+func (k *checker) checkBuiltinCall(sig *checkSig, args []string, form *List) {
+	split := strings.Split(sig.types, ",")
+	if len(split) == 1 && split[0] == "**" {
+		return
+	}
+	for i, t := range split {
+		if i >= len(args) {
+			if t == "**" {
+				return
+			}
+			k.errorf(form, "Function '%s' expected %d args, got %d", sig.name, len(split), len(args))
+			return
+		}
+		switch t {
+		case "**":
+			return
+		case "*":
+			continue
+		case "+":
+			for j, a := range args[i:] {
+				if !typeOverlaps(a, split[i-1]) {
+					k.errorf(form, "Function '%s' expected argument %d of type '%s', got '%s'", sig.name, i+j, split[i-1], a)
+				}
+			}
+			return
+		default:
+			if !typeOverlaps(args[i], t) {
+				k.errorf(form, "Function '%s' expected argument %d of type '%s', got '%s'", sig.name, i, t, args[i])
+			}
+		}
+	}
+	if len(args) > len(split) {
+		k.errorf(form, "Function '%s' expected %d args, got %d", sig.name, len(split), len(args))
+	}
+}
+
+func (k *checker) expand(m *List, form *List, s *checkScope) checkValue {
+	name := m.children[1].Value().(string)
+	argnames := m.children[2].(*List)
+	subs := make(map[string]Value)
+	for i, a := range argnames.children {
+		if i >= len(form.children)-1 {
+			k.errorf(form, "Not enough arguments to macro '%s'. Expected %d, got %d.", name, len(argnames.children), len(form.children)-1)
+			return anyValue
+		}
+		if a.Type() == "identifier" {
+			subs[a.Value().(string)] = form.children[i+1]
+		} else if a.Type() == "expansion" {
+			subs[a.Value().(string)] = &List{children: form.children[1+i:]}
+			break
+		}
+	}
+	if k.depth > 64 {
+		return anyValue
+	}
+	k.depth++
+	defer func() { k.depth-- }()
+	last := checkValue{t: "nil"}
+	for _, r := range m.children[3:] {
+		for _, b := range NestedReplace(r.Copy(), &subs) {
+			last = k.check(b, s)
+		}
+	}
+	return last
+}
+
+func (k *checker) checkBody(body []Value, s *checkScope) checkValue {
+	last := checkValue{t: "nil"}
+	for _, n := range body {
+		last = k.check(n, s)
+	}
+	return last
+}
+
+// lambdaSig builds the signature of a lambda form from its argument list and
+// return annotation, without looking at the body.
+func (k *checker) lambdaSig(name string, form *List) *checkSig {
+	sig := &checkSig{name: name, ret: "*", keywords: make(map[string]bool)}
+	if len(form.children) < 3 || form.children[1].Type() != "list" {
+		return sig
+	}
+	for _, a := range form.children[1].(*List).children {
+		switch a.Type() {
+		case "identifier", "typed id":
+			sig.params = append(sig.params, paramType(a))
+			sig.required++
+		case "expansion":
+			sig.rest = true
+		case "symbol":
+			sig.keywords[a.Value().(string)] = true
+		case "list":
+			l := a.(*List)
+			if len(l.children) != 2 {
+				continue
+			}
+			if l.children[0].Type() == "symbol" {
+				sig.keywords[l.children[0].Value().(string)] = true
+			} else {
+				sig.params = append(sig.params, paramType(l.children[0]))
+			}
+		}
+	}
+	if _, ret, _ := lambdaParts(form); ret != "" {
+		sig.ret = ret
+	}
+	return sig
+}
+
+func (k *checker) checkLambda(sig *checkSig, form *List, s *checkScope) checkValue {
+	if len(form.children) < 3 {
+		k.errorf(form, "Wrong number of arguments to 'lambda'")
+		return anyValue
+	}
+	if form.children[1].Type() != "list" {
+		k.errorf(form, "lambda expected argument 0 of type 'list', got type '%s'", form.children[1].Type())
+		return anyValue
+	}
+	inner := newCheckScope(s)
+	for _, a := range form.children[1].(*List).children {
+		switch a.Type() {
+		case "identifier", "typed id":
+			inner.vars[paramName(a)] = checkValue{t: paramType(a)}
+		case "expansion":
+			inner.vars[a.Value().(string)] = checkValue{t: "list"}
+		case "symbol":
+			inner.vars[paramName(a)] = anyValue
+		case "list":
+			l := a.(*List)
+			if len(l.children) != 2 {
+				k.errorf(form, "Optional argument '%s' must be of form '(identifier default)'", l.String())
+				continue
+			}
+			d := k.check(l.children[1], inner)
+			if l.children[0].Type() == "symbol" {
+				inner.vars[paramName(l.children[0])] = d
+			} else {
+				inner.vars[paramName(l.children[0])] = checkValue{t: paramType(l.children[0])}
+			}
+		default:
+			k.errorf(form, "Cannot use type '%s' in function argument list", a.Type())
+		}
+	}
+	_, annotation, body := lambdaParts(form)
+	annotated := annotation != ""
+	k.lambdas++
+	ret := k.check(body, inner)
+	k.lambdas--
+	if annotated {
+		if !typeOverlaps(ret.t, sig.ret) {
+			k.errorf(form, "Function '%s' returns '%s', expected '%s'", sig.name, ret.t, sig.ret)
+		}
+	} else {
+		sig.ret = ret.t
+	}
+	return checkValue{t: "function", sig: sig}
+}
+
+func checkLambdaForm(k *checker, form *List, s *checkScope) checkValue {
+	return k.checkLambda(k.lambdaSig("anonymous", form), form, s)
+}
+
+func checkDefForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) == 4 && form.children[2].Type() == "string" {
+		form = &List{children: []Value{form.children[0], form.children[1], form.children[3]}, pos: form.pos}
+	}
+	if len(form.children) != 3 {
+		k.errorf(form, "Wrong number of arguments to 'def'")
+		return anyValue
+	}
+	if form.children[1].Type() != "identifier" {
+		k.errorf(form, "def expected argument 0 of type 'identifier', got type '%s'", form.children[1].Type())
+		return anyValue
+	}
+	name := form.children[1].Value().(string)
+	var v checkValue
+	if l, ok := form.children[2].(*List); ok && isForm(l, "lambda") {
+		// bind the signature first so that recursive calls are checked
+		sig := k.lambdaSig(name, l)
+		k.define(name, checkValue{t: "function", sig: sig}, s)
+		v = k.checkLambda(sig, l, s)
+	} else {
+		v = k.check(form.children[2], s)
+	}
+	k.define(name, v, s)
+	return v
+}
+
+func checkDoForm(k *checker, form *List, s *checkScope) checkValue {
+	return k.checkBody(form.children[1:], s)
+}
+
+func checkIfForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) < 3 || len(form.children) > 4 {
+		k.errorf(form, "Wrong number of arguments to 'if'")
+		return anyValue
+	}
+	k.check(form.children[1], s)
+	t := k.check(form.children[2], s).t
+	if len(form.children) > 3 {
+		return checkValue{t: typeUnion(t, k.check(form.children[3], s).t)}
+	}
+	return checkValue{t: typeUnion(t, "nil")}
+}
+
+func checkWhileForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) < 2 {
+		k.errorf(form, "Wrong number of arguments to 'while'")
+		return anyValue
+	}
+	k.check(form.children[1], s)
+	return checkValue{t: typeUnion(k.checkBody(form.children[2:], s).t, "nil")}
+}
+
+func checkForForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) != 3 {
+		k.errorf(form, "First argument to 'for' must be a list of form '(identifier list)'")
+		return checkValue{t: "list"}
+	}
+	params, ok := form.children[1].(*List)
+	if !ok || len(params.children) != 2 || params.children[0].Type() != "identifier" {
+		k.errorf(form, "First argument to 'for' must be a list of form '(identifier list)'")
+		return checkValue{t: "list"}
+	}
+	inner := newCheckScope(s)
+	if t := k.check(params.children[1], inner).t; !typeOverlaps(t, "list|seq") {
+		k.errorf(form, "Second argument of 'for' parameters must evaluate to a list or seq, got '%s'", t)
+	}
+	inner.vars[params.children[0].Value().(string)] = anyValue
+	k.check(form.children[2], inner)
+	return checkValue{t: "list"}
+}
+
+func checkLetForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) < 2 {
+		k.errorf(form, "First argument to 'let' must be a list of form '(identifier list)'")
+		return anyValue
+	}
+	params, ok := form.children[1].(*List)
+	if !ok {
+		k.errorf(form, "First argument to 'let' must be a list of form '(identifier list)'")
+		return anyValue
+	}
+	inner := newCheckScope(s)
+	for i := 0; i < len(params.children); i += 2 {
+		if params.children[i].Type() != "identifier" {
+			k.errorf(form, "Even parameters to 'let' must be identifiers")
+			continue
+		}
+		v := checkValue{t: "nil"}
+		if len(params.children) > i+1 {
+			v = k.check(params.children[i+1], inner)
+		}
+		inner.vars[params.children[i].Value().(string)] = v
+	}
+	return k.checkBody(form.children[2:], inner)
+}
+
+func checkAssertForm(k *checker, form *List, s *checkScope) checkValue {
+	k.checkBody(form.children[1:], s)
+	return checkValue{t: "bool"}
+}
+
+func checkInputForm(k *checker, form *List, s *checkScope) checkValue {
+	return checkValue{t: "string"}
+}
+
+func checkMacroForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) < 3 || form.children[1].Type() != "identifier" || form.children[2].Type() != "list" {
+		k.errorf(form, "macro expected arguments of type 'identifier' and 'list'")
+		return anyValue
+	}
+	v := checkValue{t: "macro", macro: form}
+	k.define(form.children[1].Value().(string), v, s)
+	return v
+}
+
+func checkSetBangForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) != 3 {
+		k.errorf(form, "Wrong number of arguments to 'set!'")
+		return anyValue
+	}
+	if form.children[1].Type() != "identifier" {
+		k.errorf(form, "set! expected argument 0 of type 'identifier', got type '%s'", form.children[1].Type())
+		return anyValue
+	}
+	k.lookup(form.children[1], s)
+	return k.check(form.children[2], s)
+}
+
+func checkNamespaceForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) < 2 || form.children[1].Type() != "identifier" {
+		k.errorf(form, "namespace expected argument 0 of type 'identifier'")
+		return anyValue
+	}
+	inner := newCheckScope(s.root())
+	inner.ns = strings.Join([]string{s.ns, form.children[1].Value().(string)}, "/")
+	return k.checkBody(form.children[2:], inner)
+}
+
+func checkImportForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) != 2 {
+		k.errorf(form, "Wrong number of arguments to 'import'")
+		return anyValue
+	}
+	fname, err := importPath(form.children[1])
+	if err != nil {
+		k.errorf(form, "%v", err)
+		return anyValue
+	}
+	fname = resolvePath(k.dir, fname)
+	if k.imported[fname] {
+		return anyValue
+	}
+	k.imported[fname] = true
+	nodes, err := readImport(fname)
+	if err != nil {
+		k.errorf(form, "error during import of '%s': %v", fname, err)
+		return anyValue
+	}
+	return k.checkAll(nodes, s)
+}
+
+func checkGuardForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) < 2 {
+		k.errorf(form, "Wrong number of arguments to 'guard'")
+		return anyValue
+	}
+	t := k.check(form.children[1], s).t
+	if len(form.children) > 2 {
+		h := k.check(form.children[2], s)
+		if h.sig != nil {
+			return checkValue{t: typeUnion(t, h.sig.ret)}
+		}
+		return anyValue
+	}
+	return checkValue{t: typeUnion(t, "nil")}
+}
+
+func checkCondForm(k *checker, form *List, s *checkScope) checkValue {
+	t := "nil"
+	for _, pair := range form.children[1:] {
+		l, ok := pair.(*List)
+		if !ok {
+			k.errorf(form, "Statements in body of 'cond' must be of type 'list', not '%s'", pair.Type())
+			continue
+		}
+		if len(l.children) != 2 {
+			k.errorf(l, "Statements in body of 'cond' should have length of two (bool body)")
+			continue
+		}
+		k.check(l.children[0], s)
+		t = typeUnion(t, k.check(l.children[1], s).t)
+	}
+	return checkValue{t: t}
+}
+
+func checkDefgenericForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) < 3 || form.children[1].Type() != "identifier" {
+		k.errorf(form, "defgeneric expected arguments of type 'identifier' and 'list'")
+		return anyValue
+	}
+	v := checkValue{t: "generic"}
+	k.define(form.children[1].Value().(string), v, s)
+	if len(form.children) == 4 {
+		l := &List{children: []Value{form.children[0], form.children[2], form.children[3]}}
+		k.checkLambda(k.lambdaSig(form.children[1].Value().(string), l), l, s)
+	}
+	return v
+}
+
+func checkDefmethodForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) != 4 || form.children[1].Type() != "identifier" {
+		k.errorf(form, "Wrong number of arguments to 'defmethod'")
+		return anyValue
+	}
+	name := form.children[1].Value().(string)
+	if g := k.lookup(form.children[1], s); g.t != "generic" && g.t != "*" {
+		k.errorf(form, "Cannot define method on '%s' of type '%s', expected 'generic'", name, g.t)
+	}
+	l := &List{children: []Value{form.children[0], form.children[2], form.children[3]}}
+	k.checkLambda(k.lambdaSig(name, l), l, s)
+	return checkValue{t: "generic"}
+}
+
+func checkDeftypeForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) != 2 || form.children[1].Type() != "identifier" {
+		k.errorf(form, "Wrong number of arguments to 'deftype'")
+		return anyValue
+	}
+	name := form.children[1].Value().(string)
+	if builtinTypes[name] {
+		k.errorf(form, "Cannot redefine builtin type '%s'", name)
+		return anyValue
+	}
+	v := checkValue{t: "function", sig: &checkSig{name: name, params: []string{"*"}, required: 1, ret: name}}
+	k.define(name, v, s)
+	return v
+}
+
+func checkSelectForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) < 2 {
+		k.errorf(form, "Wrong number of arguments to 'select'")
+		return anyValue
+	}
+	t := ""
+	hasDefault := false
+	for _, x := range form.children[1:] {
+		clause, ok := x.(*List)
+		if !ok || len(clause.children) < 1 || clause.children[0].Type() != "identifier" {
+			k.errorf(form, "Clauses of 'select' must be lists starting with 'recv', 'send' or 'default'")
+			continue
+		}
+		inner := newCheckScope(s)
+		body := clause.children[1:]
+		switch clause.children[0].Value().(string) {
+		case "recv", "send":
+			if len(clause.children) < 3 {
+				k.errorf(clause, "Wrong number of arguments to '%s' clause of 'select'", clause.children[0].Value().(string))
+				continue
+			}
+			if ch := k.check(clause.children[1], s).t; !typeOverlaps(ch, "chan") {
+				k.errorf(clause, "select expected a value of type 'chan', got type '%s'", ch)
+			}
+			if clause.children[0].Value().(string) == "send" {
+				k.check(clause.children[2], s)
+			} else if clause.children[2].Type() == "identifier" {
+				inner.vars[clause.children[2].Value().(string)] = anyValue
+			}
+			body = clause.children[3:]
+		case "default":
+			if hasDefault {
+				k.errorf(clause, "select cannot have more than one 'default' clause")
+			}
+			hasDefault = true
+		default:
+			k.errorf(clause, "Unknown 'select' clause '%s'", clause.children[0].Value().(string))
+			continue
+		}
+		r := k.checkBody(body, inner).t
+		if t == "" {
+			t = r
+		} else {
+			t = typeUnion(t, r)
+		}
+	}
+	if t == "" {
+		t = "nil"
+	}
+	return checkValue{t: t}
+}
+
+func checkTraceForm(k *checker, form *List, s *checkScope) checkValue {
+	for _, a := range form.children[1:] {
+		if a.Type() != "identifier" {
+			k.errorf(form, "%s expected arguments of type 'identifier', got type '%s'", form.children[0], a.Type())
+			continue
+		}
+		if v := k.lookup(a, s); v.t != "function" && v.t != "*" {
+			k.errorf(form, "Cannot trace value of type '%s'", v.t)
+		}
+	}
+	return checkValue{t: "nil"}
+}
+
+func checkProfileForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) < 2 || len(form.children) > 3 {
+		k.errorf(form, "Wrong number of arguments to 'profile'")
+		return anyValue
+	}
+	if len(form.children) == 3 {
+		if t := k.check(form.children[2], s).t; !typeOverlaps(t, "string") {
+			k.errorf(form, "profile expected argument 1 of type 'string', got type '%s'", t)
+		}
+	}
+	return k.check(form.children[1], s)
+}
+
+func paramName(a Value) string {
+	x := a.Value().(string)
+	if a.Type() == "symbol" {
+		return x[1:]
+	}
+	if j := strings.Index(x, "#"); j > -1 {
+		return x[:j]
+	}
+	return x
+}
+
+func paramType(a Value) string {
+	if a.Type() != "typed id" {
+		return "*"
+	}
+	x := a.Value().(string)
+	return x[strings.Index(x, "#")+1:]
+}
+
+func typeUnion(a, b string) string {
+	if a == "*" || b == "*" {
+		return "*"
+	}
+	seen := make(map[string]bool)
+	for _, t := range append(strings.Split(a, "|"), strings.Split(b, "|")...) {
+		seen[t] = true
+	}
+	out := []string{}
+	for t := range seen {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return strings.Join(out, "|")
+}
+
+func typeOverlaps(a, b string) bool {
+	if a == "*" || b == "*" {
+		return true
+	}
+	for _, x := range strings.Split(a, "|") {
+		for _, y := range strings.Split(b, "|") {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkQuoteForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) != 2 {
+		k.errorf(form, "Wrong number of arguments to 'quote'")
+		return anyValue
+	}
+	return checkValue{t: form.children[1].Type()}
+}
+
+func checkDefreaderForm(k *checker, form *List, s *checkScope) checkValue {
+	if len(form.children) < 4 || form.children[1].Type() != "identifier" {
+		k.errorf(form, "Wrong number of arguments to 'defreader'")
+		return anyValue
+	}
+	return checkLambdaForm(k, &List{children: append([]Value{form.children[0]}, form.children[2:]...), pos: form.pos}, s)
+}
+
+func checkReaderMacroForm(k *checker, form *List, s *checkScope) checkValue {
+	// what the form means is up to the reader macro
+	return anyValue
+}
+
+func init() {
+	checkForms = map[string]checkForm{
+		"lambda":       checkLambdaForm,
+		"def":          checkDefForm,
+		"do":           checkDoForm,
+		"if":           checkIfForm,
+		"while":        checkWhileForm,
+		"for":          checkForForm,
+		"let":          checkLetForm,
+		"assert":       checkAssertForm,
+		"input":        checkInputForm,
+		"macro":        checkMacroForm,
+		"set!":         checkSetBangForm,
+		"namespace":    checkNamespaceForm,
+		"import":       checkImportForm,
+		"guard":        checkGuardForm,
+		"cond":         checkCondForm,
+		"defgeneric":   checkDefgenericForm,
+		"defmethod":    checkDefmethodForm,
+		"deftype":      checkDeftypeForm,
+		"select":       checkSelectForm,
+		"time-it":      checkDoForm,
+		"trace":        checkTraceForm,
+		"untrace":      checkTraceForm,
+		"profile":      checkProfileForm,
+		"quote":        checkQuoteForm,
+		"defreader":    checkDefreaderForm,
+		"reader-macro": checkReaderMacroForm,
+	}
+}
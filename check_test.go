@@ -0,0 +1,62 @@
+package sigmo
+
+import (
+	"strings"
+	"testing"
+)
+
+func checkString(t *testing.T, src string) []error {
+	t.Helper()
+	nodes, err := ParseFile("<test>", src)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", src, err)
+	}
+	return Check(nodes)
+}
+
+func TestCheckDiagnostics(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(+ 1 2) (cat "a" "b")`, ""},
+		{`(cat (len "abc") "x")`, "Function 'cat' expected argument 0 of type 'string', got 'int'"},
+		{`(+ 1 (time/now))`, "Function '+' expected argument 1 of type 'int|float', got 'time'"},
+		{`(hget {} 1)`, "Function 'hget' expected argument 1 of type 'string|symbol', got 'int'"},
+		{`(lambda (a#int) (cat a "x"))`, "expected argument 0 of type 'string', got 'int'"},
+		{`(let (x 1) (cat x "a"))`, "expected argument 0 of type 'string', got 'int'"},
+		{`(def n (len "a")) (not n)`, "Function 'not' expected argument 0 of type 'bool', got 'int'"},
+		{`(undefined-thing 1)`, "Unknown identifier 'undefined-thing'"},
+		{`(if 1)`, "Wrong number of arguments to 'if'"},
+		{`(for)`, "First argument to 'for' must be a list"},
+		{`(let)`, "let"},
+		{`(select)`, "Wrong number of arguments to 'select'"},
+		{`(deftype list)`, "Cannot redefine builtin type 'list'"},
+		{`(def f (lambda (a (b 2) (:k 3)) a)) (f)`, "Function 'f' expected 1 to 2 args, got 0"},
+		{`(def f (lambda (a (b 2) (:k 3)) a)) (f 1 :k 4)`, ""},
+		{`(def f (lambda (a) #int "s"))`, "int"},
+	} {
+		errs := checkString(t, tc.src)
+		switch {
+		case tc.want == "" && len(errs) > 0:
+			t.Errorf("%s: got %v, want no errors", tc.src, errs)
+		case tc.want != "" && (len(errs) == 0 || !strings.Contains(errs[0].Error(), tc.want)):
+			t.Errorf("%s: got %v, want an error containing %q", tc.src, errs, tc.want)
+		}
+	}
+}
+
+// TestBuiltinReturns checks the return types declared with the builtins are
+// all types values can have.
+func TestBuiltinReturns(t *testing.T) {
+	for name, fn := range builtins {
+		if fn.ret == "" {
+			continue
+		}
+		for _, r := range strings.Split(fn.ret, "|") {
+			if !builtinTypes[r] {
+				t.Errorf("%s returns unknown type '%s'", name, r)
+			}
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ktravis/sigmo"
+)
+
+var (
+	command     = flag.String("c", "", "run a single command")
+	interactive = flag.Bool("i", false, "drop into the cli after running a file")
+	trace       = flag.Bool("trace", false, "log every special form and function application, with its result")
+	traceDepth  = flag.Int("trace-depth", 0, "leave lists nested deeper than this out of -trace, unless 0")
+	traceOut    = flag.String("trace-out", "", "write traces to this file instead of stderr")
+	profile     = flag.String("profile", "", "write a pprof profile of the calls made to this file")
+	noCache     = flag.Bool("no-cache", false, "parse imported files every time instead of caching them")
+	image       = flag.String("image", "", "start from an image written by 'sigmo image' instead of a fresh context")
+)
+
+// located adds the position a parse error occurred at to its message.
+func located(err error) error {
+	if pe, ok := err.(*sigmo.ParseError); ok {
+		return fmt.Errorf("%v: %s", pe.Pos, pe.Msg)
+	}
+	return err
+}
+
+func run(file string, src string, c sigmo.Context) error {
+	nodes, err := sigmo.ParseFile(file, src)
+	if err != nil {
+		return located(err)
+	}
+	for _, n := range nodes {
+		r := n.Eval(c)
+		if r.Type() == "error" {
+			return fmt.Errorf("%v", r.Value())
+		}
+	}
+	return nil
+}
+
+// stream evaluates the forms read from in as each one is complete.
+func stream(file string, in io.Reader, c sigmo.Context) error {
+	r := sigmo.NewReader(in, file)
+	for {
+		n, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return located(err)
+		}
+		if v := n.Eval(c); v.Type() == "error" {
+			return fmt.Errorf("%v", v.Value())
+		}
+	}
+}
+
+func check(files []string) int {
+	status := 0
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		nodes, err := sigmo.ParseFile(f, string(data))
+		if err != nil {
+			fmt.Printf("%s: %v\n", f, err)
+			status = 1
+			continue
+		}
+		for _, e := range sigmo.Check(nodes) {
+			fmt.Printf("%s: %v\n", f, e)
+			status = 1
+		}
+	}
+	return status
+}
+
+// format prints the formatted source of each file, or with -check lists
+// the files that aren't formatted, or with -write rewrites them.
+func format(args []string) int {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	checkOnly := fs.Bool("check", false, "list files whose formatting differs, and exit 1 if there are any")
+	write := fs.Bool("write", false, "write the result back to each file instead of printing it")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		out, err := sigmo.Format("<stdin>", string(data))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Print(out)
+		return 0
+	}
+	status := 0
+	for _, f := range fs.Args() {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		out, err := sigmo.Format(f, string(data))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		switch {
+		case *checkOnly:
+			if out != string(data) {
+				fmt.Println(f)
+				status = 1
+			}
+		case *write:
+			if out != string(data) {
+				if err := ioutil.WriteFile(f, []byte(out), 0644); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					status = 1
+				}
+			}
+		default:
+			fmt.Print(out)
+		}
+	}
+	return status
+}
+
+// lint prints the issues Lint finds in each file, one per line as
+// 'file:line:col rule message'.
+func lint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	enable := fs.String("enable", "", "comma separated rules to run, instead of all of them")
+	disable := fs.String("disable", "", "comma separated rules to skip")
+	list := fs.Bool("list", false, "list the rules")
+	fs.Parse(args)
+
+	if *list {
+		names := []string{}
+		for name := range sigmo.LintRules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-16s %s\n", name, sigmo.LintRules[name])
+		}
+		return 0
+	}
+	rules := make(map[string]bool)
+	for name := range sigmo.LintRules {
+		rules[name] = *enable == ""
+	}
+	for _, names := range []struct {
+		list string
+		on   bool
+	}{{*enable, true}, {*disable, false}} {
+		for _, name := range strings.Split(names.list, ",") {
+			if name == "" {
+				continue
+			}
+			if _, ok := sigmo.LintRules[name]; !ok {
+				fmt.Fprintf(os.Stderr, "unknown lint rule '%s'\n", name)
+				return 2
+			}
+			rules[name] = names.on
+		}
+	}
+
+	status := 0
+	for _, f := range fs.Args() {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		issues, err := sigmo.Lint(f, string(data), rules)
+		if err != nil {
+			fmt.Println(err)
+			status = 1
+			continue
+		}
+		for _, i := range issues {
+			fmt.Println(i)
+			status = 1
+		}
+	}
+	return status
+}
+
+// debug runs a file under the debugger, stopping at the first form unless
+// breakpoints are given.
+func debug(args []string) int {
+	fs := flag.NewFlagSet("debug", flag.ExitOnError)
+	breaks := fs.String("break", "", "comma separated breakpoints, each a file:line or function name")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: sigmo debug [-break points] file.mo")
+		return 2
+	}
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	d := sigmo.NewDebugger(os.Stdin, os.Stdout)
+	for _, b := range strings.Split(*breaks, ",") {
+		if b == "" {
+			continue
+		}
+		if err := d.Break(b); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if *breaks == "" {
+		d.Step()
+	}
+	sigmo.SetDebugHook(d)
+	if err := run(fs.Arg(0), string(data), sigmo.NewContext(nil)); err != nil {
+		fmt.Println("error:", err)
+		return 1
+	}
+	return 0
+}
+
+// saveImage runs the files in turn in a fresh context, and saves it as an
+// image.
+func saveImage(args []string) int {
+	fs := flag.NewFlagSet("image", flag.ExitOnError)
+	out := fs.String("o", "sigmo.img", "the file to write the image to")
+	fs.Parse(args)
+
+	c := sigmo.NewContext(nil)
+	for _, f := range fs.Args() {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := run(f, string(data), c); err != nil {
+			fmt.Println("error:", err)
+			return 1
+		}
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := sigmo.SaveImage(f, c); err != nil {
+		f.Close()
+		os.Remove(*out)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := f.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// cache manages the cache of parsed imports.
+func cache(args []string) int {
+	if len(args) != 1 || args[0] != "clean" {
+		fmt.Fprintln(os.Stderr, "usage: sigmo cache clean")
+		return 2
+	}
+	if err := sigmo.CleanCache(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// loadImage returns the context saved in an image.
+func loadImage(file string) (sigmo.Context, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return sigmo.LoadImage(bufio.NewReader(f))
+}
+
+func writeProfile(file string, p *sigmo.Profiler) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := p.WriteProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func main() {
+	flag.Parse()
+	if *noCache {
+		sigmo.CacheDir = ""
+	}
+
+	switch flag.Arg(0) {
+	case "check":
+		os.Exit(check(flag.Args()[1:]))
+	case "fmt":
+		os.Exit(format(flag.Args()[1:]))
+	case "lint":
+		os.Exit(lint(flag.Args()[1:]))
+	case "cache":
+		os.Exit(cache(flag.Args()[1:]))
+	case "image":
+		os.Exit(saveImage(flag.Args()[1:]))
+	case "debug":
+		os.Exit(debug(flag.Args()[1:]))
+	case "lsp":
+		if err := sigmo.ServeLSP(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *trace && *profile != "" {
+		fmt.Fprintln(os.Stderr, "-trace and -profile can't be used together")
+		os.Exit(2)
+	}
+	var traceFile *os.File
+	if *traceOut != "" {
+		f, err := os.Create(*traceOut)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		traceFile = f
+		sigmo.TraceOutput = f
+	}
+	if *trace {
+		sigmo.SetDebugHook(sigmo.NewTracer(sigmo.TraceOutput, *traceDepth))
+	}
+	var profiler *sigmo.Profiler
+	if *profile != "" {
+		profiler = sigmo.NewProfiler()
+		sigmo.SetDebugHook(profiler)
+	}
+
+	status := execute()
+	if profiler != nil {
+		profiler.Stop()
+		if err := writeProfile(*profile, profiler); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	if traceFile != nil {
+		traceFile.Close()
+	}
+	os.Exit(status)
+}
+
+// execute runs the command, file or REPL asked for, returning the exit
+// status.
+func execute() int {
+	var c sigmo.Context = sigmo.NewContext(nil)
+	if *image != "" {
+		var err error
+		if c, err = loadImage(*image); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *image, err)
+			return 1
+		}
+	}
+	if *command != "" {
+		if err := run("<command>", *command, c); err != nil {
+			fmt.Println("error:", err)
+			return 1
+		}
+		return 0
+	}
+	if flag.Arg(0) == "-" {
+		if err := stream("<stdin>", os.Stdin, c); err != nil {
+			fmt.Println("error:", err)
+			return 1
+		}
+		return 0
+	}
+	if flag.NArg() > 0 {
+		data, err := ioutil.ReadFile(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := run(flag.Arg(0), string(data), c); err != nil {
+			fmt.Println("error:", err)
+			return 1
+		}
+		if !*interactive {
+			return 0
+		}
+	}
+	if _, err := sigmo.REPL(c); err != nil {
+		fmt.Println()
+	}
+	return 0
+}
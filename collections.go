@@ -0,0 +1,421 @@
+package sigmo
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// elements returns the elements of a collection for the eager collection
+// builtins: the children of a list, the (key value) pairs of a hash sorted by
+// key, or everything a seq or channel yields. An error is returned in place
+// of them if coll is not a collection, or if consuming it fails. Since a seq
+// is consumed to its end, builtins such as map, filter and sort give an error
+// for one known to be infinite, and never return for others that are, which
+// need take or the lazy builtins instead.
+func elements(name string, coll Value) ([]Value, Value) {
+	if isInfinite(coll) {
+		return nil, infiniteError(name)
+	}
+	switch x := coll.(type) {
+	case *List:
+		return x.children, nil
+	case *Hash:
+		entries := x.entries()
+		out := []Value{}
+		for i := 0; i+1 < len(entries); i += 2 {
+			out = append(out, &List{children: []Value{entries[i], entries[i+1]}})
+		}
+		return out, nil
+	case Iterable:
+		out := []Value{}
+		next := x.Iter()
+		for v, ok := next(); ok; v, ok = next() {
+			if v.Type() == "error" {
+				return nil, v
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}
+	return nil, Atom{t: "error", value: fmt.Sprintf("Function '%s' cannot have '%s' as argtype, expected 'list|hash|seq|chan'.", name, coll.Type())}
+}
+
+// each calls fn on the elements of a collection in the order elements
+// returns them, stopping early if fn returns false, so that only as much of a
+// seq as is needed is consumed. It returns an error if coll is not a
+// collection, or if consuming it fails.
+func each(name string, coll Value, fn func(Value) bool) Value {
+	if it, ok := coll.(Iterable); ok && coll.Type() != "list" {
+		next := it.Iter()
+		for v, ok := next(); ok; v, ok = next() {
+			if v.Type() == "error" {
+				return v
+			}
+			if !fn(v) {
+				break
+			}
+		}
+		return nil
+	}
+	elms, err := elements(name, coll)
+	if err != nil {
+		return err
+	}
+	for _, v := range elms {
+		if !fn(v) {
+			break
+		}
+	}
+	return nil
+}
+
+func mapFunction(input *List, c Context) Value {
+	fn := input.children[0]
+	colls := [][]Value{}
+	n := -1
+	for _, coll := range input.children[1:] {
+		elms, err := elements("map", coll)
+		if err != nil {
+			return err
+		}
+		if n < 0 || len(elms) < n {
+			n = len(elms)
+		}
+		colls = append(colls, elms)
+	}
+	out := &List{}
+	for i := 0; i < n; i++ {
+		args := []Value{}
+		for _, elms := range colls {
+			args = append(args, elms[i])
+		}
+		r := Apply(fn, args, c)
+		if r.Type() == "error" {
+			return r
+		}
+		out.children = append(out.children, r)
+	}
+	return out
+}
+
+// matching calls the predicate fn on each element of coll and returns the
+// elements it was true for, stopping at the first of them if stop is set.
+func matching(name string, fn Value, coll Value, c Context, stop bool) ([]Value, Value) {
+	out := []Value{}
+	var err Value
+	if e := each(name, coll, func(v Value) bool {
+		r := Apply(fn, []Value{v}, c)
+		if r.Type() == "error" {
+			err = r
+			return false
+		}
+		if Boolean(r) {
+			out = append(out, v)
+			return !stop
+		}
+		return true
+	}); e != nil {
+		return nil, e
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func filterFunction(input *List, c Context) Value {
+	out, err := matching("filter", input.children[0], input.children[1], c, false)
+	if err != nil {
+		return err
+	}
+	return &List{children: out}
+}
+
+func findFunction(input *List, c Context) Value {
+	out, err := matching("find", input.children[0], input.children[1], c, true)
+	if err != nil {
+		return err
+	}
+	if len(out) == 0 {
+		return NIL
+	}
+	return out[0]
+}
+
+func anyFunction(input *List, c Context) Value {
+	out, err := matching("any?", input.children[0], input.children[1], c, true)
+	if err != nil {
+		return err
+	}
+	return Atom{t: "bool", value: len(out) > 0}
+}
+
+func everyFunction(input *List, c Context) Value {
+	fn := input.children[0]
+	var out Value = TRUE
+	if err := each("every?", input.children[1], func(v Value) bool {
+		r := Apply(fn, []Value{v}, c)
+		if r.Type() == "error" {
+			out = r
+			return false
+		}
+		if !Boolean(r) {
+			out = FALSE
+			return false
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	return out
+}
+
+// reduceFunction folds a collection with (fn acc element), starting from the
+// initial value if one is given after the collection, or else from its first
+// element.
+func reduceFunction(input *List, c Context) Value {
+	if len(input.children) > 3 {
+		return Atom{t: "error", value: fmt.Sprintf("Function 'reduce' expected at most 3 args, got %d.", len(input.children))}
+	}
+	fn := input.children[0]
+	elms, err := elements("reduce", input.children[1])
+	if err != nil {
+		return err
+	}
+	var acc Value
+	if len(input.children) == 3 {
+		acc = input.children[2]
+	} else if len(elms) == 0 {
+		return Atom{t: "error", value: "Function 'reduce' cannot reduce an empty collection without an initial value."}
+	} else {
+		acc, elms = elms[0], elms[1:]
+	}
+	for _, v := range elms {
+		acc = Apply(fn, []Value{acc, v}, c)
+		if acc.Type() == "error" {
+			return acc
+		}
+	}
+	return acc
+}
+
+// sortsBefore reports whether a sorts before b in their natural order, with
+// numbers compared by value and strings, symbols, identifiers and characters
+// in lexical order.
+func sortsBefore(a Value, b Value) (bool, Value) {
+	if isNumber(a) && isNumber(b) {
+		return CompareNum(a.(Atom), b.(Atom)) < 0, nil
+	}
+	if a.Type() == b.Type() {
+		switch a.Type() {
+		case "string", "symbol", "identifier":
+			return a.Value().(string) < b.Value().(string), nil
+		case "char":
+			return a.Value().(rune) < b.Value().(rune), nil
+		}
+	}
+	return false, Atom{t: "error", value: fmt.Sprintf("Cannot compare values of type '%s' and '%s'.", a.Type(), b.Type())}
+}
+
+// sortValues stably sorts elms by their keys, with the comparator cmp if it
+// isn't nil. A comparator returns either whether its first argument sorts
+// before its second, or a number less than zero when it does.
+func sortValues(elms []Value, keys []Value, cmp Value, c Context) Value {
+	idx := make([]int, len(elms))
+	for i := range idx {
+		idx[i] = i
+	}
+	var err Value
+	sort.SliceStable(idx, func(i, j int) bool {
+		if err != nil {
+			return false
+		}
+		a, b := keys[idx[i]], keys[idx[j]]
+		if cmp == nil {
+			less, e := sortsBefore(a, b)
+			err = e
+			return less
+		}
+		r := Apply(cmp, []Value{a, b}, c)
+		switch {
+		case r.Type() == "error":
+			err = r
+		case isNumber(r):
+			return CompareNum(r.(Atom), Atom{t: "int", value: 0}) < 0
+		default:
+			return Boolean(r)
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	out := &List{}
+	for _, i := range idx {
+		out.children = append(out.children, elms[i])
+	}
+	return out
+}
+
+func sortFunction(input *List, c Context) Value {
+	var cmp Value
+	args := input.children
+	if len(args) == 2 {
+		cmp, args = args[0], args[1:]
+	} else if len(args) > 2 {
+		return Atom{t: "error", value: fmt.Sprintf("Function 'sort' expected at most 2 args, got %d.", len(args))}
+	}
+	elms, err := elements("sort", args[0])
+	if err != nil {
+		return err
+	}
+	return sortValues(elms, elms, cmp, c)
+}
+
+func sortByFunction(input *List, c Context) Value {
+	var cmp Value
+	fn, args := input.children[0], input.children[1:]
+	if len(args) == 2 {
+		cmp, args = args[0], args[1:]
+	} else if len(args) > 2 {
+		return Atom{t: "error", value: fmt.Sprintf("Function 'sort-by' expected at most 3 args, got %d.", len(input.children))}
+	}
+	elms, err := elements("sort-by", args[0])
+	if err != nil {
+		return err
+	}
+	keys := []Value{}
+	for _, v := range elms {
+		k := Apply(fn, []Value{v}, c)
+		if k.Type() == "error" {
+			return k
+		}
+		keys = append(keys, k)
+	}
+	return sortValues(elms, keys, cmp, c)
+}
+
+func groupByFunction(input *List, c Context) Value {
+	fn := input.children[0]
+	elms, err := elements("group-by", input.children[1])
+	if err != nil {
+		return err
+	}
+	h := &Hash{vals: make(map[string]Value), sym_vals: make(map[string]Value)}
+	for _, v := range elms {
+		k := Apply(fn, []Value{v}, c)
+		if k.Type() == "error" {
+			return k
+		}
+		if k.Type() != "string" && k.Type() != "symbol" {
+			return Atom{t: "error", value: fmt.Sprintf("Invalid key type '%s' for hash.", k.Type())}
+		}
+		group, ok := h.Get(k)
+		if !ok {
+			group = &List{}
+			h.Set(k, group)
+		}
+		group.(*List).children = append(group.(*List).children, v)
+	}
+	return h
+}
+
+// partitionFunction splits a collection into lists of n elements, the last of
+// which holds whatever is left over.
+func partitionFunction(input *List, c Context) Value {
+	n := input.children[0].Value().(int)
+	if n < 1 {
+		return Atom{t: "error", value: fmt.Sprintf("Function 'partition' cannot make partitions of size %d.", n)}
+	}
+	elms, err := elements("partition", input.children[1])
+	if err != nil {
+		return err
+	}
+	out := &List{}
+	for i := 0; i < len(elms); i += n {
+		end := i + n
+		if end > len(elms) {
+			end = len(elms)
+		}
+		out.children = append(out.children, &List{children: append([]Value{}, elms[i:end]...)})
+	}
+	return out
+}
+
+func zipFunction(input *List, c Context) Value {
+	colls := [][]Value{}
+	n := -1
+	for _, coll := range input.children {
+		elms, err := elements("zip", coll)
+		if err != nil {
+			return err
+		}
+		if n < 0 || len(elms) < n {
+			n = len(elms)
+		}
+		colls = append(colls, elms)
+	}
+	out := &List{}
+	for i := 0; i < n; i++ {
+		tuple := &List{}
+		for _, elms := range colls {
+			tuple.children = append(tuple.children, elms[i])
+		}
+		out.children = append(out.children, tuple)
+	}
+	return out
+}
+
+func flatten(l *List, out *List) {
+	for _, v := range l.children {
+		if inner, ok := v.(*List); ok {
+			flatten(inner, out)
+		} else {
+			out.children = append(out.children, v)
+		}
+	}
+}
+
+func flattenFunction(input *List, c Context) Value {
+	elms, err := elements("flatten", input.children[0])
+	if err != nil {
+		return err
+	}
+	out := &List{}
+	flatten(&List{children: elms}, out)
+	return out
+}
+
+// distinctFunction keeps the first of each element that is repeated. Numbers
+// are equal when their values are, as '<' and '>' compare them, so that 1 and
+// 1.0 are the same, other atoms as they are by '=', and lists and hashes when
+// they print the same, while anything else is only ever equal to itself.
+func distinctFunction(input *List, c Context) Value {
+	elms, err := elements("distinct", input.children[0])
+	if err != nil {
+		return err
+	}
+	seen := make(map[atomKey]bool)
+	out := &List{}
+	for _, v := range elms {
+		var k atomKey
+		switch x := v.(type) {
+		case Atom:
+			k = atomKey{x.t, x.value}
+			if f, ok := x.value.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<62 {
+				k = atomKey{"int", int(f)}
+			}
+		case *List, *Hash:
+			k = atomKey{x.Type(), x.String()}
+		default:
+			out.children = append(out.children, v)
+			continue
+		}
+		if !seen[k] {
+			seen[k] = true
+			out.children = append(out.children, v)
+		}
+	}
+	return out
+}
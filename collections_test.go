@@ -0,0 +1,22 @@
+package sigmo
+
+import "testing"
+
+func TestCollectionExamples(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(find (lambda (x) (> x 100)) (range))`, "101"},
+		{`(any? (lambda (x) (= x 5)) (range))`, "true"},
+		{`(every? (lambda (x) (< x 5)) (range))`, "false"},
+		{`(every? (lambda (x) (> x 0)) '(1 2 3))`, "true"},
+		{`(find (lambda (x) (> x 5)) '(1 2 3))`, "nil"},
+		{`(filter (lambda (x) (> x 1)) '(1 2 3))`, "(2 3)"},
+		{`(distinct '(1 1.0 2.5 2.5 -0.0 0 "a" "a"))`, `(1 2.5 -0.0 "a")`},
+	} {
+		if got := evalString(t, NewContext(nil), tc.src).String(); got != tc.want {
+			t.Errorf("%s = %s, want %s", tc.src, got, tc.want)
+		}
+	}
+}
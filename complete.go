@@ -0,0 +1,117 @@
+package sigmo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var importRegexp = regexp.MustCompile(`\(import\s+$`)
+
+// completer returns the REPL's tab completion function, which is given the
+// line up to the cursor and returns the word being completed along with its
+// candidates. Words are completed from the names visible in c and the
+// special forms, or as file paths when they are the argument to 'import'.
+func completer(c Context) func(string) (string, []string) {
+	return completerIn(c, "")
+}
+
+// completerIn is completer with quoted import paths found relative to dir,
+// or the working directory if it is "".
+func completerIn(c Context, dir string) func(string) (string, []string) {
+	return func(head string) (string, []string) {
+		if i := openQuote(head); i >= 0 {
+			word := head[i+1:]
+			if !importRegexp.MatchString(head[:i]) {
+				return word, nil
+			}
+			return word, completePath(dir, word, true)
+		}
+		start := strings.LastIndexAny(head, " \t()[]{}'") + 1
+		word := head[start:]
+		if importRegexp.MatchString(head[:start]) {
+			return word, completePath(os.Getenv("SIGMO_ROOT")+"/", word, false)
+		}
+		if word == "" {
+			return word, nil
+		}
+		seen := make(map[string]bool)
+		matches := []string{}
+		names := c.Names()
+		for name := range specialForms {
+			names = append(names, name)
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, word) && !seen[name] {
+				seen[name] = true
+				matches = append(matches, name)
+			}
+		}
+		sort.Strings(matches)
+		return word, matches
+	}
+}
+
+// openQuote returns the index of the quote starting an unterminated string
+// in s, or -1.
+func openQuote(s string) int {
+	open := -1
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && open >= 0:
+			i++
+		case s[i] == ';' && open < 0:
+			return -1
+		case s[i] == '"':
+			if open >= 0 {
+				open = -1
+			} else {
+				open = i
+			}
+		}
+	}
+	return open
+}
+
+// completePath lists the directories and .mo files under root matching word.
+// Module paths, as used by unquoted imports, leave off the extension.
+func completePath(root string, word string, withExt bool) []string {
+	dir, base := filepath.Split(word)
+	path := filepath.Join(root, dir)
+	if path == "" {
+		path = "."
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil
+	}
+	matches := []string{}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, base) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		if f.IsDir() {
+			matches = append(matches, dir+name+"/")
+		} else if strings.HasSuffix(name, ".mo") {
+			if !withExt {
+				name = strings.TrimSuffix(name, ".mo")
+			}
+			matches = append(matches, dir+name)
+		}
+	}
+	return matches
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,70 @@
+package sigmo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestComplete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sigmo-complete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"util.mo", "uniq.mo", "notes.txt", "lib/list.mo", ".hidden.mo"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("SIGMO_ROOT", dir)
+	defer os.Unsetenv("SIGMO_ROOT")
+
+	c := NewContext(nil)
+	evalString(t, c, `(def swap-pair 1) (def swapper 2)`)
+	complete := completerIn(c, dir)
+	for _, tc := range []struct {
+		head  string
+		word  string
+		cands []string
+	}{
+		{"(swap", "swap", []string{"swap!", "swap-pair", "swapper"}},
+		{"(map (lambd", "lambd", []string{"lambda"}},
+		{"'(sele", "sele", []string{"select"}},
+		{"(", "", nil},
+		{`(cat "swa`, "swa", nil},
+		{`(import "u`, "u", []string{"uniq.mo", "util.mo"}},
+		{`(import "lib/`, "lib/", []string{"lib/list.mo"}},
+		{`(import "`, "", []string{"lib/", "uniq.mo", "util.mo"}},
+		{`(import "\"u`, `\"u`, []string{}},
+		{"(import u", "u", []string{"uniq", "util"}},
+		{"(import .h", ".h", []string{".hidden"}},
+		{`(cat "a" "b") ; "sw`, `"sw`, []string{}},
+	} {
+		word, cands := complete(tc.head)
+		if word != tc.word || !reflect.DeepEqual(cands, tc.cands) {
+			t.Errorf("completing %q = %q %q, want %q %q", tc.head, word, cands, tc.word, tc.cands)
+		}
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		words []string
+		want  string
+	}{
+		{[]string{"swap!", "swap-pair", "swapper"}, "swap"},
+		{[]string{"lambda"}, "lambda"},
+		{[]string{"ab", "cd"}, ""},
+	} {
+		if got := commonPrefix(tc.words); got != tc.want {
+			t.Errorf("commonPrefix(%q) = %q, want %q", tc.words, got, tc.want)
+		}
+	}
+}
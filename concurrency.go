@@ -0,0 +1,237 @@
+package sigmo
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Future is the result of a function run on its own goroutine by 'spawn'.
+type Future struct {
+	done   chan struct{}
+	result Value
+}
+
+func (f *Future) String() string {
+	return unreadable("future", "")
+}
+
+func (f *Future) Eval(c Context) Value {
+	return f
+}
+
+func (f *Future) Value() interface{} {
+	return NIL
+}
+
+func (f *Future) Copy() Value {
+	return f
+}
+
+func (f *Future) Type() string {
+	return "future"
+}
+
+func (f *Future) Await() Value {
+	<-f.done
+	return f.result
+}
+
+// Chan wraps a Go channel of values. Channels fed by a timer or ticker stop
+// it when closed.
+type Chan struct {
+	ch   chan Value
+	stop func()
+}
+
+func (ch *Chan) String() string {
+	return unreadable("chan", "")
+}
+
+func (ch *Chan) Eval(c Context) Value {
+	return ch
+}
+
+func (ch *Chan) Value() interface{} {
+	return NIL
+}
+
+func (ch *Chan) Copy() Value {
+	return ch
+}
+
+func (ch *Chan) Type() string {
+	return "chan"
+}
+
+// Iter receives from the channel until it is closed.
+func (ch *Chan) Iter() Iterator {
+	return func() (Value, bool) {
+		v, ok := <-ch.ch
+		return v, ok
+	}
+}
+
+func (ch *Chan) Send(v Value) (out Value) {
+	defer func() {
+		if r := recover(); r != nil {
+			out = Atom{t: "error", value: "Cannot send on a closed channel"}
+		}
+	}()
+	ch.ch <- v
+	return v
+}
+
+func (ch *Chan) Close() (out Value) {
+	defer func() {
+		if r := recover(); r != nil {
+			out = Atom{t: "error", value: "Cannot close a closed channel"}
+		}
+	}()
+	if ch.stop != nil {
+		ch.stop()
+	}
+	close(ch.ch)
+	return NIL
+}
+
+func spawnFunction(input *List, c Context) Value {
+	f := &Future{done: make(chan struct{})}
+	fn, args := input.children[0], input.children[1:]
+	go func() {
+		defer close(f.done)
+		defer func() {
+			if r := recover(); r != nil {
+				f.result = Atom{t: "error", value: fmt.Sprintf("Spawned task failed: %v", r)}
+			}
+		}()
+		f.result = Apply(fn, args, c)
+	}()
+	return f
+}
+
+func awaitFunction(input *List, c Context) Value {
+	return input.children[0].(*Future).Await()
+}
+
+func chanFunction(input *List, c Context) Value {
+	size := 0
+	if len(input.children) > 0 {
+		if input.children[0].Type() != "int" {
+			return Atom{t: "error", value: fmt.Sprintf("Function 'chan' cannot have '%s' as argtype, expected 'int'.", input.children[0].Type())}
+		}
+		size = input.children[0].Value().(int)
+	}
+	return &Chan{ch: make(chan Value, size)}
+}
+
+func sendBangFunction(input *List, c Context) Value {
+	return input.children[0].(*Chan).Send(input.children[1])
+}
+
+func recvFunction(input *List, c Context) Value {
+	v, ok := <-input.children[0].(*Chan).ch
+	if !ok {
+		return NIL
+	}
+	return v
+}
+
+func closeBangFunction(input *List, c Context) Value {
+	return input.children[0].(*Chan).Close()
+}
+
+// selectForm waits on several channel operations, running the body of the
+// first one that can proceed:
+//
+//	(select
+//	  (recv ch x body...)
+//	  (send ch value body...)
+//	  (default body...))
+func selectForm(form *List, c Context) Value {
+	if len(form.children) < 2 {
+		return Atom{t: "error", value: "Wrong number of arguments to 'select'"}
+	}
+	cases := []reflect.SelectCase{}
+	clauses := []*List{}
+	hasDefault := false
+	for _, x := range form.children[1:] {
+		clause, ok := x.(*List)
+		if !ok || len(clause.children) < 1 || clause.children[0].Type() != "identifier" {
+			return Atom{t: "error", value: fmt.Sprintf("Clauses of 'select' must be of form '(recv chan identifier body...)', '(send chan value body...)' or '(default body...)', not '%s'", x.String())}
+		}
+		switch clause.children[0].Value().(string) {
+		case "recv", "send":
+			if len(clause.children) < 3 {
+				return Atom{t: "error", value: fmt.Sprintf("Wrong number of arguments to '%s' clause of 'select'", clause.children[0].Value().(string))}
+			}
+			ch := clause.children[1].Eval(c)
+			if ch.Type() != "chan" {
+				return Atom{t: "error", value: fmt.Sprintf("select expected a value of type 'chan', got type '%s'", ch.Type())}
+			}
+			sc := reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch.(*Chan).ch)}
+			if clause.children[0].Value().(string) == "send" {
+				v := clause.children[2].Eval(c)
+				if v.Type() == "error" {
+					return v
+				}
+				sc.Dir = reflect.SelectSend
+				sc.Send = reflect.ValueOf(&v).Elem()
+			} else if clause.children[2].Type() != "identifier" {
+				return Atom{t: "error", value: fmt.Sprintf("recv clause of 'select' expected argument 1 of type 'identifier', got type '%s'", clause.children[2].Type())}
+			}
+			cases = append(cases, sc)
+		case "default":
+			if hasDefault {
+				return Atom{t: "error", value: "select cannot have more than one 'default' clause"}
+			}
+			hasDefault = true
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+		default:
+			return Atom{t: "error", value: fmt.Sprintf("Unknown 'select' clause '%s'", clause.children[0].Value().(string))}
+		}
+		clauses = append(clauses, clause)
+	}
+	var (
+		chosen int
+		recv   reflect.Value
+		ok     bool
+		err    Value
+	)
+	func() {
+		// a send clause on a closed channel panics, as a send does
+		defer func() {
+			if r := recover(); r != nil {
+				if e, ok := r.(error); !ok || e.Error() != "send on closed channel" {
+					panic(r)
+				}
+				err = Atom{t: "error", value: "Cannot send on a closed channel"}
+			}
+		}()
+		chosen, recv, ok = reflect.Select(cases)
+	}()
+	if err != nil {
+		return err
+	}
+	clause := clauses[chosen]
+	inner := NewContext(c)
+	body := clause.children[1:]
+	switch clause.children[0].Value().(string) {
+	case "recv":
+		var v Value = NIL
+		if ok {
+			v = recv.Interface().(Value)
+		}
+		inner.Set(clause.children[2].Value().(string), v)
+		body = clause.children[3:]
+	case "send":
+		body = clause.children[3:]
+	}
+	var last Value = NIL
+	for _, n := range body {
+		last = n.Eval(inner)
+		if last.Type() == "error" {
+			return last
+		}
+	}
+	return last
+}
@@ -0,0 +1,47 @@
+package sigmo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelect(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `(def ch (chan 1)) (def closed (chan)) (close! closed)`)
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(select (recv ch v v) (default :empty))`, ":empty"},
+		{`(select (send ch 42 :sent) (default :full))`, ":sent"},
+		{`(select (send ch 43 :sent) (default :full))`, ":full"},
+		{`(select (recv ch v (+ v 1)))`, "43"},
+		{`(select (recv closed v v))`, "nil"},
+		{`(await (spawn (lambda (x) (* x 2)) 21))`, "42"},
+		{`(do (def f (spawn (lambda () (recv ch)))) (send! ch "hi") (await f))`, `"hi"`},
+	} {
+		if got := evalString(t, c, tc.src).String(); got != tc.want {
+			t.Errorf("%s = %s, want %s", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestSelectErrors(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `(def closed (chan 1)) (close! closed)`)
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(select)`, "Wrong number of arguments to 'select'"},
+		{`(select (default 1) (default 2))`, "more than one 'default' clause"},
+		{`(select (send closed 1 :sent))`, "Cannot send on a closed channel"},
+		{`(select (recv 1 v v))`, "expected a value of type 'chan', got type 'int'"},
+		{`(select (wait closed))`, "Unknown 'select' clause 'wait'"},
+		{`(select (recv closed 1 1))`, "expected argument 1 of type 'identifier'"},
+	} {
+		if got := evalError(t, c, tc.src); !strings.Contains(got, tc.want) {
+			t.Errorf("%s: got error %q, want %q", tc.src, got, tc.want)
+		}
+	}
+}
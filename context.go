@@ -2,7 +2,9 @@ package sigmo
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 )
 
 type Context interface {
@@ -11,11 +13,19 @@ type Context interface {
 	Set(string, Value) Value
 	SetExisting(string, Value) Value
 	CopyLocals() map[string]Value
+	Names() []string
+	Doc(string) string
+	SetDoc(string, string)
 }
 
+// context is safe for concurrent use, so a single root context with a
+// prelude loaded can be shared by many goroutines. Giving each of them its
+// own NewContext(root) keeps their definitions apart.
 type context struct {
+	mu         sync.RWMutex
 	parent     Context
 	scope      map[string]Value
+	docs       map[string]string
 	ns         string
 	namespaces map[string]Context
 }
@@ -25,6 +35,7 @@ func NewContext(parent Context) *context {
 		parent:     parent,
 		namespaces: make(map[string]Context),
 		scope:      make(map[string]Value),
+		docs:       make(map[string]string),
 	}
 	if parent == nil {
 		setBuiltins(c)
@@ -33,6 +44,8 @@ func NewContext(parent Context) *context {
 }
 
 func (c *context) CopyLocals() map[string]Value {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	m := make(map[string]Value)
 	for k, v := range c.scope {
 		m[k] = v.Copy()
@@ -53,7 +66,9 @@ func (c *context) Get(identifier string) Value {
 			return n.Get(identifier)
 		}
 	}
+	c.mu.RLock()
 	a, ok := c.scope[identifier]
+	c.mu.RUnlock()
 	if ok {
 		return a
 	}
@@ -80,16 +95,21 @@ func (c *context) Set(identifier string, l Value) Value {
 			return x.Set(identifier, l)
 		}
 	}
+	c.mu.Lock()
 	c.scope[identifier] = l
+	c.mu.Unlock()
 	return l
 }
 
 func (c *context) SetExisting(identifier string, l Value) Value {
 	// TODO: what about ns?
+	c.mu.Lock()
 	if _, ok := c.scope[identifier]; ok {
 		c.scope[identifier] = l
+		c.mu.Unlock()
 		return l
 	}
+	c.mu.Unlock()
 	if c.parent != nil {
 		return c.parent.SetExisting(identifier, l)
 	}
@@ -102,19 +122,124 @@ func (c *context) Namespace(path string) Context {
 	}
 	if strings.Contains(path, "/") {
 		paths := strings.SplitN(path, "/", 2)
+		c.mu.RLock()
 		x, exists := c.namespaces[paths[0]]
+		c.mu.RUnlock()
 		if !exists {
 			// TODO: err?
 			return nil
 		}
 		return x.Namespace(paths[1])
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	x, exists := c.namespaces[path]
 	if !exists {
 		newCtx := NewContext(c)
-		c.namespaces[path] = newCtx
 		newCtx.ns = strings.Join([]string{c.ns, path}, "/")
+		c.namespaces[path] = newCtx
 		return newCtx
 	}
 	return x
 }
+
+// lookupNamespace returns the namespace at path, or nil if there isn't one,
+// where Namespace would make it.
+func lookupNamespace(c Context, path string) Context {
+	x, ok := c.(*context)
+	if !ok {
+		return c.Namespace(path)
+	}
+	for p, ok := x.parent.(*context); ok; p, ok = x.parent.(*context) {
+		x = p
+	}
+	var ns Context = x
+	for _, name := range strings.Split(path, "/") {
+		x, ok := ns.(*context)
+		if !ok {
+			return nil
+		}
+		x.mu.RLock()
+		ns, ok = x.namespaces[name]
+		x.mu.RUnlock()
+		if !ok {
+			return nil
+		}
+	}
+	return ns
+}
+
+// Names lists every identifier visible from c, including those in parent
+// scopes, with namespaced identifiers given in their 'ns/name' form.
+func (c *context) Names() []string {
+	seen := make(map[string]bool)
+	if c.parent != nil {
+		for _, n := range c.parent.Names() {
+			seen[n] = true
+		}
+	}
+	c.mu.RLock()
+	for k := range c.scope {
+		seen[k] = true
+	}
+	namespaces := make(map[string]Context)
+	for path, ns := range c.namespaces {
+		namespaces[path] = ns
+	}
+	c.mu.RUnlock()
+	for path, ns := range namespaces {
+		if x, ok := ns.(*context); ok {
+			x.namespacedNames(path, seen)
+		}
+	}
+	names := []string{}
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *context) namespacedNames(prefix string, seen map[string]bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for k := range c.scope {
+		seen[prefix+"/"+k] = true
+	}
+	for path, ns := range c.namespaces {
+		if x, ok := ns.(*context); ok {
+			x.namespacedNames(prefix+"/"+path, seen)
+		}
+	}
+}
+
+func (c *context) Doc(identifier string) string {
+	if strings.Contains(identifier, "/") {
+		paths := strings.Split(identifier, "/")
+		ns := strings.Join(paths[:len(paths)-1], "/")
+		identifier = paths[len(paths)-1]
+		if c.ns != ns {
+			n := c.Namespace(ns)
+			if n == nil {
+				return ""
+			}
+			return n.Doc(identifier)
+		}
+	}
+	c.mu.RLock()
+	d, ok := c.docs[identifier]
+	c.mu.RUnlock()
+	if ok {
+		return d
+	}
+	if c.parent != nil {
+		return c.parent.Doc(identifier)
+	}
+	return ""
+}
+
+func (c *context) SetDoc(identifier string, doc string) {
+	c.mu.Lock()
+	c.docs[identifier] = doc
+	c.mu.Unlock()
+}
@@ -0,0 +1,83 @@
+package sigmo
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func evalString(t *testing.T, c Context, src string) Value {
+	t.Helper()
+	nodes, err := ParseFile("<test>", src)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", src, err)
+	}
+	var last Value = NIL
+	for _, n := range nodes {
+		if last = n.Eval(c); last.Type() == "error" {
+			t.Errorf("evaluating %q: %v", src, last.Value())
+		}
+	}
+	return last
+}
+
+// TestConcurrentAccess shares a context, hash and generic between goroutines,
+// and is meant to be run with -race.
+func TestConcurrentAccess(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `(defgeneric area (x)) (defmethod area (x#int) (* x x)) (def shared {"n" 0})`)
+	h := c.Get("shared").(*Hash)
+	g := c.Get("area").(*Generic)
+	method := evalString(t, c, `(lambda (x#float) (* x x))`).(Function)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			inner := NewContext(c)
+			for j := 0; j < 200; j++ {
+				name := fmt.Sprintf("v%d", j%10)
+				c.Set(name, Atom{t: "int", value: j})
+				c.Get(name)
+				inner.Set("local", Atom{t: "int", value: i})
+				inner.CopyLocals()
+				c.Names()
+				c.Namespace("ns").Set(name, NIL)
+
+				h.Set(Atom{t: "string", value: name}, Atom{t: "int", value: j})
+				h.Get(Atom{t: "string", value: "n"})
+				_ = h.String()
+
+				g.AddMethod(&List{children: []Value{Atom{t: "typed id", value: "x#float"}}}, method)
+				if r := g.Call(&List{children: []Value{Atom{t: "int", value: 3}}}, inner); r.Type() == "error" {
+					t.Errorf("calling area: %v", r.Value())
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := len(h.vals); n != 11 {
+		t.Errorf("hash has %d keys, want 11", n)
+	}
+}
+
+// TestSpawnSharesContext runs goroutines from the language itself, all
+// swapping the same ref and setting the same hash.
+func TestSpawnSharesContext(t *testing.T) {
+	c := NewContext(nil)
+	r := evalString(t, c, `
+(def counter (ref 0))
+(def seen {})
+(def work (lambda (i)
+  (for (j (collect (range 50)))
+    (do
+      (swap! counter + 1)
+      (hset! seen (string j) i)))))
+(for (f (for (i (collect (range 8))) (spawn work i))) (await f))
+(deref counter)`)
+	if r.Type() != "int" || r.Value().(int) != 400 {
+		t.Errorf("counter is %v, want 400", r)
+	}
+}
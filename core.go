@@ -2,7 +2,9 @@ package sigmo
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 )
 
 var (
@@ -28,6 +30,7 @@ type Container interface {
 type List struct {
 	children []Value
 	Quoted   bool
+	pos      Pos
 }
 
 func (l *List) String() string {
@@ -45,6 +48,18 @@ func (l *List) Eval(c Context) Value {
 	if l.Quoted {
 		return l
 	}
+	if h := currentHook(); h != nil {
+		if v := h.Enter(l, c); v != nil {
+			return v
+		}
+		v := l.eval(c)
+		h.Leave(l, c, v)
+		return v
+	}
+	return l.eval(c)
+}
+
+func (l *List) eval(c Context) Value {
 	output := List{}
 	if len(l.children) > 0 {
 		first := l.children[0]
@@ -78,6 +93,10 @@ func (l *List) Eval(c Context) Value {
 			l := List{children: output.children[1:]}
 			return n.(Function).Call(&l, c)
 		}
+		if n.Type() == "generic" {
+			l := List{children: output.children[1:]}
+			return n.(*Generic).Call(&l, c)
+		}
 	}
 	return &output
 }
@@ -87,7 +106,7 @@ func (l *List) Value() interface{} {
 }
 
 func (l *List) Copy() Value {
-	n := List{Quoted: l.Quoted}
+	n := List{Quoted: l.Quoted, pos: l.pos}
 	for _, el := range l.children {
 		n.children = append(n.children, el.Copy())
 	}
@@ -98,6 +117,10 @@ func (l *List) Type() string {
 	return "list"
 }
 
+func (l *List) Pos() Pos {
+	return l.pos
+}
+
 func (l *List) Length() Atom {
 	return Atom{t: "int", value: len(l.children)}
 }
@@ -106,7 +129,19 @@ func (l *List) Append(v Value) {
 	l.children = append(l.children, v)
 }
 
+func (l *List) Iter() Iterator {
+	i := 0
+	return func() (Value, bool) {
+		if i >= len(l.children) {
+			return nil, false
+		}
+		i++
+		return l.children[i-1], true
+	}
+}
+
 type Hash struct {
+	mu       sync.RWMutex
 	pairs    []Value
 	vals     map[string]Value
 	sym_vals map[string]Value
@@ -143,15 +178,41 @@ func MakeHash(pairs []Value, c Context) Value {
 
 func (h *Hash) String() string {
 	elms := []string{}
-	for k, v := range h.vals {
-		elms = append(elms, k, v.String())
-	}
-	for k, v := range h.sym_vals {
-		elms = append(elms, k, v.String())
+	for _, v := range h.entries() {
+		elms = append(elms, v.String())
 	}
 	return fmt.Sprintf("{%s}", strings.Join(elms, " "))
 }
 
+// entries returns the keys and values of h in turn, sorted by key, or the
+// pairs it was written with if it has not been evaluated yet.
+func (h *Hash) entries() []Value {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.pairs) > 0 {
+		return h.pairs
+	}
+	keys := []Value{}
+	for k := range h.vals {
+		keys = append(keys, Atom{t: "string", value: k})
+	}
+	for k := range h.sym_vals {
+		keys = append(keys, Atom{t: "symbol", value: k})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+	out := []Value{}
+	for _, k := range keys {
+		if k.Type() == "string" {
+			out = append(out, k, h.vals[k.Value().(string)])
+		} else {
+			out = append(out, k, h.sym_vals[k.Value().(string)])
+		}
+	}
+	return out
+}
+
 func (h *Hash) Eval(c Context) Value {
 	if len(h.pairs) > 0 {
 		return MakeHash(h.pairs, c)
@@ -164,8 +225,13 @@ func (h *Hash) Value() interface{} {
 }
 
 func (h *Hash) Copy() Value {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 	n := Hash{vals: make(map[string]Value),
 		sym_vals: make(map[string]Value)}
+	for _, v := range h.pairs {
+		n.pairs = append(n.pairs, v.Copy())
+	}
 	for k, v := range h.vals {
 		n.vals[k] = v.Copy()
 	}
@@ -180,9 +246,33 @@ func (h *Hash) Type() string {
 }
 
 func (h *Hash) Length() Atom {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 	return Atom{t: "int", value: len(h.vals) + len(h.sym_vals)}
 }
 
+func (h *Hash) keys(key Value) map[string]Value {
+	if key.Type() == "symbol" {
+		return h.sym_vals
+	}
+	return h.vals
+}
+
+// Get looks up a string or symbol key.
+func (h *Hash) Get(key Value) (Value, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	v, ok := h.keys(key)[key.Value().(string)]
+	return v, ok
+}
+
+// Set stores v under a string or symbol key.
+func (h *Hash) Set(key Value, v Value) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keys(key)[key.Value().(string)] = v
+}
+
 func (h *Hash) Append(l Value) {
 	h.pairs = append(h.pairs, l)
 }
@@ -197,17 +287,21 @@ func (a Atom) String() string {
 	case "int":
 		return fmt.Sprintf("%d", a.value)
 	case "float":
-		return fmt.Sprintf("%f", a.value)
+		return formatFloat(a.value.(float64))
 	case "bool":
 		return fmt.Sprintf("%t", a.value)
-	case "identifier":
+	case "identifier", "typed id":
 		return a.value.(string)
+	case "expansion":
+		return a.value.(string) + "..."
 	case "symbol":
 		return fmt.Sprintf("%s", a.value)
 	case "string":
-		return fmt.Sprintf("\"%s\"", a.value)
+		return quoteString(a.value.(string))
 	case "type":
 		return fmt.Sprintf("#%s", a.value)
+	case "char":
+		return charString(a.value.(rune))
 	}
 	return a.t
 }
@@ -242,10 +336,31 @@ func (a Atom) Length() Atom {
 	}
 }
 
-type Function func(*List, Context) Value
+type Function struct {
+	name  string
+	types string
+	// ret is the type a builtin returns, for the checker, or "" if it
+	// could be anything
+	ret    string
+	fn     func(*List, Context) Value
+	doc    string
+	args   *List
+	source *List
+	// env is what a lambda closes over
+	env map[string]Value
+}
+
+// unreadable writes a value that has no literal form, such as a function,
+// so that the reader rejects it rather than reading something else.
+func unreadable(kind string, detail string) string {
+	if detail == "" {
+		return "#<" + kind + ">"
+	}
+	return "#<" + kind + " " + detail + ">"
+}
 
 func (f Function) String() string {
-	return "{fn}"
+	return unreadable("fn", f.name)
 }
 
 func (f Function) Eval(c Context) Value {
@@ -265,15 +380,41 @@ func (f Function) Type() string {
 }
 
 func (f Function) Call(args *List, c Context) Value {
-	return f(args, c)
+	if name, ok := tracedName(f); ok {
+		return traceCall(name, f, args, c)
+	}
+	return f.fn(args, c)
+}
+
+// returns sets the type the checker expects f to return.
+func (f Function) returns(t string) Function {
+	f.ret = t
+	return f
+}
+
+func (f Function) Signature() string {
+	if f.args != nil {
+		return signature(f.name, f.args)
+	}
+	return typesSignature(f.name, f.types)
 }
 
 // "*"
 
+// hasType reports whether t is one of the '|' separated type names in types.
+func hasType(types string, t string) bool {
+	for _, x := range strings.Split(types, "|") {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
 func NewFunction(name string, types string, fn func(*List, Context) Value) Function {
 	split := strings.Split(types, ",")
 	if len(split) == 1 && split[0] == "**" {
-		return Function(fn)
+		return Function{name: name, types: types, fn: fn}
 	}
 	wrapped := func(args *List, c Context) Value {
 		expanded := false
@@ -296,14 +437,14 @@ func NewFunction(name string, types string, fn func(*List, Context) Value) Funct
 					return Atom{t: "error", value: fmt.Sprintf("Function '%s' cannot have '+' as first argtype parameter.", name)}
 				}
 				for _, r := range args.children[i:] {
-					if !strings.Contains(split[i-1], r.Type()) {
+					if !hasType(split[i-1], r.Type()) {
 						return Atom{t: "error", value: fmt.Sprintf("Function '%s' cannot have '%s' as argtype, expected '%s'.", name, r.Type(), split[i-1])}
 					}
 				}
 				expanded = true
 				break
 			default:
-				if !strings.Contains(t, a) {
+				if !hasType(t, a) {
 					return Atom{t: "error", value: fmt.Sprintf("Function '%s' cannot have '%s' as argtype, expected '%s'.", name, a, t)}
 				}
 
@@ -314,13 +455,20 @@ func NewFunction(name string, types string, fn func(*List, Context) Value) Funct
 		}
 		return fn(args, c)
 	}
-	return Function(wrapped)
+	return Function{name: name, types: types, fn: wrapped}
 }
 
-type Macro func(*List, Context) Value
+type Macro struct {
+	name   string
+	types  string
+	fn     func(*List, Context) Value
+	doc    string
+	args   *List
+	source *List
+}
 
 func (m Macro) String() string {
-	return "{macro}"
+	return unreadable("macro", m.name)
 }
 
 func (m Macro) Eval(c Context) Value {
@@ -340,13 +488,28 @@ func (m Macro) Type() string {
 }
 
 func (m Macro) Call(args *List, c Context) Value {
-	return m(args, c)
+	return m.fn(args, c)
+}
+
+// Expand returns the forms a call to the macro expands to.
+func (m Macro) Expand(call *List) ([]Value, error) {
+	if m.source == nil {
+		return nil, fmt.Errorf("Cannot expand builtin macro '%s'", m.name)
+	}
+	return expandMacro(m.source, call)
+}
+
+func (m Macro) Signature() string {
+	if m.args != nil {
+		return signature(m.name, m.args)
+	}
+	return typesSignature(m.name, m.types)
 }
 
 func NewMacro(name string, types string, fn func(*List, Context) Value) Macro {
 	split := strings.Split(types, ",")
 	if len(split) == 1 && split[0] == "**" {
-		return Macro(fn)
+		return Macro{name: name, types: types, fn: fn}
 	}
 	wrapped := func(args *List, c Context) Value {
 		expanded := false
@@ -366,14 +529,14 @@ func NewMacro(name string, types string, fn func(*List, Context) Value) Macro {
 					return &Atom{t: "error", value: fmt.Sprintf("Macro '%s' cannot have '+' as first argtype parameter.", name)}
 				}
 				for _, r := range args.children[i:] {
-					if !strings.Contains(split[i-1], r.Type()) {
+					if !hasType(split[i-1], r.Type()) {
 						return &Atom{t: "error", value: fmt.Sprintf("Macro '%s' cannot have '%s' as argtype, expected '%s'.", name, r.Type(), split[i-1])}
 					}
 				}
 				expanded = true
 				break
 			default:
-				if !strings.Contains(t, a) {
+				if !hasType(t, a) {
 					return &Atom{t: "error", value: fmt.Sprintf("Macro '%s' cannot have '%s' as argtype, expected '%s'.", name, a, t)}
 				}
 
@@ -384,41 +547,285 @@ func NewMacro(name string, types string, fn func(*List, Context) Value) Macro {
 		}
 		return fn(args, c)
 	}
-	return Macro(wrapped)
+	return Macro{name: name, types: types, fn: wrapped}
 }
 
-func ParseArgs(argnames *List, argvals *List, c Context) Value {
-	for i, a := range argnames.children {
-		if i >= len(argvals.children) && a.Type() != "expansion" {
-			return Atom{t: "error", value: "Not enough arguments to function"}
+type method struct {
+	types []string
+	rest  bool
+	fn    Function
+}
+
+func (m *method) Matches(args *List) bool {
+	if len(args.children) < len(m.types) || (!m.rest && len(args.children) > len(m.types)) {
+		return false
+	}
+	for i, t := range m.types {
+		if t != "" && args.children[i].Type() != t {
+			return false
 		}
+	}
+	return true
+}
+
+func (m *method) Specificity() int {
+	n := 0
+	for _, t := range m.types {
+		if t != "" {
+			n++
+		}
+	}
+	return n
+}
+
+type Generic struct {
+	mu       sync.RWMutex
+	name     string
+	args     *List
+	methods  []*method
+	fallback Value
+}
+
+func NewGeneric(name string) *Generic {
+	return &Generic{name: name}
+}
+
+func (g *Generic) String() string {
+	return unreadable("generic", g.name)
+}
+
+func (g *Generic) Eval(c Context) Value {
+	return g
+}
+
+func (g *Generic) Value() interface{} {
+	return NIL
+}
+
+func (g *Generic) Copy() Value {
+	return g
+}
+
+func (g *Generic) Type() string {
+	return "generic"
+}
+
+// AddMethod registers fn for the given argument list, replacing any method
+// with the same type signature. Methods are kept sorted so that the most
+// specific match is tried first.
+func (g *Generic) AddMethod(argnames *List, fn Function) Value {
+	m := &method{fn: fn}
+	for i, a := range argnames.children {
 		switch a.Type() {
 		case "identifier":
-			c.Set(a.Value().(string), argvals.children[i].Copy())
+			m.types = append(m.types, "")
+		case "typed id":
+			x := a.Value().(string)
+			m.types = append(m.types, x[strings.Index(x, "#")+1:])
+		case "expansion":
+			if i != len(argnames.children)-1 {
+				return Atom{t: "error", value: fmt.Sprintf("Expansion '%s' must be the last argument of method '%s'", a.Value().(string), g.name)}
+			}
+			m.rest = true
+		default:
+			return Atom{t: "error", value: fmt.Sprintf("Cannot use type '%s' in method argument list", a.Type())}
+		}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// Calls in flight may still be walking the old slice, so build a new one.
+	methods := append([]*method{}, g.methods...)
+	for i, o := range methods {
+		if o.rest == m.rest && strings.Join(o.types, ",") == strings.Join(m.types, ",") {
+			methods[i] = m
+			g.methods = methods
+			return g
+		}
+	}
+	methods = append(methods, m)
+	sort.SliceStable(methods, func(i, j int) bool {
+		return methods[i].Specificity() > methods[j].Specificity()
+	})
+	g.methods = methods
+	return g
+}
+
+func (g *Generic) Call(args *List, c Context) Value {
+	g.mu.RLock()
+	methods, fallback := g.methods, g.fallback
+	g.mu.RUnlock()
+	for _, m := range methods {
+		if m.Matches(args) {
+			return m.fn.Call(args, c)
+		}
+	}
+	if fallback != nil {
+		return fallback.(Function).Call(args, c)
+	}
+	types := []string{}
+	for _, a := range args.children {
+		types = append(types, "#"+a.Type())
+	}
+	return Atom{t: "error", value: fmt.Sprintf("No method '%s' for (%s)", g.name, strings.Join(types, " "))}
+}
+
+// Tagged wraps a value with a user-defined type name, as created by the
+// constructor functions that 'deftype' defines.
+type Tagged struct {
+	t     string
+	value Value
+}
+
+func (t *Tagged) String() string {
+	return fmt.Sprintf("(%s %s)", t.t, t.value.String())
+}
+
+func (t *Tagged) Eval(c Context) Value {
+	return t
+}
+
+func (t *Tagged) Value() interface{} {
+	return t.value
+}
+
+func (t *Tagged) Copy() Value {
+	return &Tagged{t: t.t, value: t.value.Copy()}
+}
+
+func (t *Tagged) Type() string {
+	return t.t
+}
+
+// ParseArgs binds argvals to the names in argnames within c. Besides plain
+// and typed identifiers, argnames may contain optional arguments given as
+// '(name default)', keyword arguments given as ':name' or '(:name default)',
+// and a trailing 'rest...' expansion.
+func ParseArgs(name string, argnames *List, argvals *List, c Context) Value {
+	keywords := make(map[string]Value)
+	for _, a := range argnames.children {
+		if a.Type() == "symbol" {
+			keywords[a.Value().(string)] = NIL
+		} else if l, ok := a.(*List); ok && len(l.children) == 2 && l.children[0].Type() == "symbol" {
+			keywords[l.children[0].Value().(string)] = l.children[1]
+		}
+	}
+	vals := []Value{}
+	given := make(map[string]Value)
+	for i := 0; i < len(argvals.children); i++ {
+		v := argvals.children[i]
+		if v.Type() == "symbol" && i+1 < len(argvals.children) {
+			if _, ok := keywords[v.Value().(string)]; ok {
+				given[v.Value().(string)] = argvals.children[i+1]
+				i++
+				continue
+			}
+		}
+		vals = append(vals, v)
+	}
+	i := 0
+	for _, a := range argnames.children {
+		switch a.Type() {
+		case "identifier", "typed id":
+			if i >= len(vals) {
+				return Atom{t: "error", value: fmt.Sprintf("Not enough arguments to function '%s', expected %s, got %d", name, signature(name, argnames), len(vals))}
+			}
+			if err := bindArg(a, vals[i], c); err != nil {
+				return err
+			}
+			i++
 		case "expansion":
 			children := []Value{}
-			for _, x := range argvals.children[i:] {
+			for _, x := range vals[i:] {
 				children = append(children, x.Copy())
 			}
 			c.Set(a.Value().(string), &List{children: children})
-			return nil
-		case "typed id":
-			x := a.Value().(string)
-			j := strings.Index(x, "#")
-			t := x[j+1:]
-			x = x[:j]
-			if argvals.children[i].Type() != t {
-				if conv := c.Get(t); conv.Type() == "function" {
-					temp := &List{children: []Value{argvals.children[i]}}
-					c.Set(x, conv.(Function).Call(temp, c))
-					continue
-				}
-				return Atom{t: "error", value: fmt.Sprintf("Expected argument '%s' of type '%s', got '%s'", x, t, argvals.children[i].Type())}
+			i = len(vals)
+		case "symbol":
+		case "list":
+			l := a.(*List)
+			if len(l.children) != 2 || !(l.children[0].Type() == "identifier" || l.children[0].Type() == "typed id" || l.children[0].Type() == "symbol") {
+				return Atom{t: "error", value: fmt.Sprintf("Optional argument '%s' must be of form '(identifier default)'", l.String())}
+			}
+			if l.children[0].Type() == "symbol" {
+				continue
+			}
+			var v Value
+			if i < len(vals) {
+				v = vals[i]
+				i++
+			} else if v = l.children[1].Eval(c); v.Type() == "error" {
+				return v
+			}
+			if err := bindArg(l.children[0], v, c); err != nil {
+				return err
 			}
-			c.Set(x, argvals.children[i])
 		default:
 			return Atom{t: "error", value: fmt.Sprintf("Cannot use type '%s' in function argument list", a.Type())}
 		}
 	}
+	if i < len(vals) {
+		return Atom{t: "error", value: fmt.Sprintf("Too many arguments to function '%s', expected %s, got %d", name, signature(name, argnames), len(vals))}
+	}
+	for k, d := range keywords {
+		v, ok := given[k]
+		if !ok {
+			if v = d.Eval(c); v.Type() == "error" {
+				return v
+			}
+		}
+		c.Set(k[1:], v.Copy())
+	}
 	return nil
 }
+
+func bindArg(a Value, v Value, c Context) Value {
+	if a.Type() == "identifier" {
+		c.Set(a.Value().(string), v.Copy())
+		return nil
+	}
+	x := a.Value().(string)
+	j := strings.Index(x, "#")
+	t := x[j+1:]
+	x = x[:j]
+	if v.Type() != t {
+		if conv := c.Get(t); conv.Type() == "function" {
+			temp := &List{children: []Value{v}}
+			res := conv.(Function).Call(temp, c)
+			if res.Type() == "error" {
+				return res
+			}
+			c.Set(x, res)
+			return nil
+		}
+		return Atom{t: "error", value: fmt.Sprintf("Expected argument '%s' of type '%s', got '%s'", x, t, v.Type())}
+	}
+	c.Set(x, v)
+	return nil
+}
+
+func signature(name string, argnames *List) string {
+	elms := []string{name}
+	for _, a := range argnames.children {
+		elms = append(elms, a.String())
+	}
+	return fmt.Sprintf("(%s)", strings.Join(elms, " "))
+}
+
+// typesSignature describes a NewFunction argtype string, so "int|float,+"
+// for '+' becomes "(+ int|float int|float...)".
+func typesSignature(name string, types string) string {
+	elms := []string{name}
+	for _, t := range strings.Split(types, ",") {
+		switch t {
+		case "*":
+			elms = append(elms, "any")
+		case "**":
+			elms = append(elms, "any...")
+		case "+":
+			elms = append(elms, elms[len(elms)-1]+"...")
+		default:
+			elms = append(elms, t)
+		}
+	}
+	return fmt.Sprintf("(%s)", strings.Join(elms, " "))
+}
@@ -0,0 +1,167 @@
+package sigmo
+
+import (
+	"strings"
+	"testing"
+)
+
+// evalError evaluates src, which is expected to fail, and returns the
+// message of the first error.
+func evalError(t *testing.T, c Context, src string) string {
+	t.Helper()
+	nodes, err := ParseFile("<test>", src)
+	if err != nil {
+		return err.Error()
+	}
+	for _, n := range nodes {
+		if v := n.Eval(c); v.Type() == "error" {
+			return v.Value().(string)
+		}
+	}
+	t.Fatalf("evaluating %q: no error", src)
+	return ""
+}
+
+// TestUserTypeArgs passes values of user types named like parts of builtin
+// type names to builtins taking those types.
+func TestUserTypeArgs(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `(deftype ash) (deftype is) (deftype ist)`)
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(hget (ash 1) "x")`, "cannot have 'ash' as argtype, expected 'hash'"},
+		{`(len (ist 1))`, "cannot have 'ist' as argtype"},
+		{`(+ 1 (is 2))`, "cannot have 'is' as argtype"},
+	} {
+		if got := evalError(t, c, tc.src); !strings.Contains(got, tc.want) {
+			t.Errorf("%s: got error %q, want %q", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestHasType(t *testing.T) {
+	for _, tc := range []struct {
+		types string
+		t     string
+		want  bool
+	}{
+		{"int|float", "int", true},
+		{"int|float", "float", true},
+		{"hash", "ash", false},
+		{"list|hash|seq|chan", "is", false},
+		{"list|hash|seq|chan", "chan", true},
+		{"string", "", false},
+	} {
+		if got := hasType(tc.types, tc.t); got != tc.want {
+			t.Errorf("hasType(%q, %q) = %v, want %v", tc.types, tc.t, got, tc.want)
+		}
+	}
+}
+
+func TestGenericDispatch(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `
+(deftype circle)
+(deftype square)
+(defgeneric area (s) 0)
+(defmethod area (s#circle) (* 3 (unwrap s)))
+(defmethod area (s#square) (* (unwrap s) (unwrap s)))
+(defgeneric describe (a b))
+(defmethod describe (a b) "any")
+(defmethod describe (a#int b) "int first")
+(defmethod describe (a#int b#int) "ints")
+(defmethod describe (a#string rest...) (cat "rest " a))`)
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(area (circle 2))`, "6"},
+		{`(area (square 3))`, "9"},
+		{`(area "x")`, "0"},
+		{`(describe 1 2)`, `"ints"`},
+		{`(describe 1 "a")`, `"int first"`},
+		{`(describe "a" 1)`, `"rest a"`},
+		{`(describe :k 1)`, `"any"`},
+		{`(type (circle 1))`, "#circle"},
+		{`(circle (circle 1))`, "(circle 1)"},
+		{`(type (unwrap (circle 1)))`, "#int"},
+		{`(map area (cons (circle 1) '(2)))`, "(3 0)"},
+		{`(do (defmethod area (s#circle) 42) (area (circle 2)))`, "42"},
+	} {
+		if got := evalString(t, c, tc.src).String(); got != tc.want {
+			t.Errorf("%s = %s, want %s", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestGenericErrors(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `(defgeneric g (x)) (def notgeneric 1)`)
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(g 1)`, "No method 'g' for (#int)"},
+		{`(defmethod notgeneric (x) x)`, "Cannot define method on 'notgeneric' of type 'int', expected 'generic'"},
+		{`(defmethod g (rest... x) x)`, "must be the last argument"},
+		{`(defmethod g (x))`, "Wrong number of arguments to 'defmethod'"},
+		{`(deftype int)`, "Cannot redefine builtin type 'int'"},
+		{`(deftype "circle")`, "deftype expected argument 0 of type 'identifier'"},
+	} {
+		if got := evalError(t, c, tc.src); !strings.Contains(got, tc.want) {
+			t.Errorf("%s: got error %q, want %q", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestOptionalArgs(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `
+(def f (lambda (a (b 2) (:k 3)) (cat (string a) (string b) (string k))))
+(def r (lambda (a rest...) rest))
+(def kd (lambda ((:x (+ 1 1))) x))
+(def typed (lambda (a#int (b 1)) a))`)
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(f 1)`, `"123"`},
+		{`(f 1 5)`, `"153"`},
+		{`(f 1 :k 9)`, `"129"`},
+		{`(f 1 5 :k 9)`, `"159"`},
+		{`(f :k 9 1)`, `"129"`},
+		{`(r 1)`, "()"},
+		{`(r 1 2 3)`, "(2 3)"},
+		{`(kd)`, "2"},
+		{`(kd :x 5)`, "5"},
+		{`(typed 2.5)`, "2"},
+		{`(arglist f)`, "'(a (b 2) (:k 3))"},
+	} {
+		if got := evalString(t, c, tc.src).String(); got != tc.want {
+			t.Errorf("%s = %s, want %s", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestArgErrors(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `
+(def f (lambda (a (b 2) (:k 3)) a))
+(def typed (lambda (a#int (b 1)) a))`)
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(f)`, "Not enough arguments to function 'f', expected (f a (b 2) (:k 3)), got 0"},
+		{`(f 1 2 3)`, "Too many arguments to function 'f', expected (f a (b 2) (:k 3)), got 3"},
+		{`(typed "s")`, "Function 'int' cannot have 'string' as argtype"},
+		{`((lambda ((a 1 2)) a))`, "Optional argument '(a 1 2)' must be of form '(identifier default)'"},
+		{`(float "s")`, "Function 'float' cannot have 'string' as argtype"},
+	} {
+		if got := evalError(t, c, tc.src); !strings.Contains(got, tc.want) {
+			t.Errorf("%s: got error %q, want %q", tc.src, got, tc.want)
+		}
+	}
+}
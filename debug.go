@@ -0,0 +1,451 @@
+package sigmo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DebugHook is called by List.Eval around the evaluation of every list that
+// isn't quoted, including calls to special forms and macros. If Enter returns
+// a value other than nil, the list is not evaluated and that value is used
+// in its place, without Leave being called.
+type DebugHook interface {
+	Enter(form *List, c Context) Value
+	Leave(form *List, c Context, result Value)
+}
+
+// CallHook is implemented by a DebugHook that also wants the calls builtins
+// such as map and sort make to the functions passed to them, which aren't
+// evaluated as lists. LeaveCall is called after every EnterCall.
+type CallHook interface {
+	EnterCall(fn Value, c Context)
+	LeaveCall(fn Value, c Context, result Value)
+}
+
+// hookBox lets the hook be kept in an atomic.Value, which needs every value
+// stored in it to be of the same type.
+type hookBox struct {
+	h DebugHook
+}
+
+var debugHook atomic.Value
+
+// SetDebugHook installs h to be called by every evaluation from then on, or
+// removes the current hook if h is nil.
+func SetDebugHook(h DebugHook) {
+	debugHook.Store(hookBox{h})
+}
+
+func currentHook() DebugHook {
+	if b, ok := debugHook.Load().(hookBox); ok {
+		return b.h
+	}
+	return nil
+}
+
+const (
+	debugContinue = iota
+	debugStep
+	debugNext
+	debugFinish
+	debugQuit
+)
+
+type debugFrame struct {
+	form *List
+	c    Context
+}
+
+type breakpoint struct {
+	file string
+	line int
+	name string
+}
+
+func (b breakpoint) String() string {
+	if b.name != "" {
+		return b.name
+	}
+	return fmt.Sprintf("%s:%d", b.file, b.line)
+}
+
+// matches reports whether b stops at form, whose enclosing list is parent.
+// Line breakpoints only stop at the outermost list starting on their line.
+func (b breakpoint) matches(form *List, parent *List) bool {
+	if b.name != "" {
+		if len(form.children) == 0 || form.children[0].Type() != "identifier" {
+			return false
+		}
+		name := form.children[0].Value().(string)
+		return name == b.name || strings.HasSuffix(name, "/"+b.name)
+	}
+	p := form.pos
+	if !p.IsValid() || p.Line != b.line {
+		return false
+	}
+	file := filepath.Clean(p.File)
+	if file != b.file && !strings.HasSuffix(file, "/"+b.file) {
+		return false
+	}
+	return parent == nil || parent.pos.Line != p.Line || parent.pos.File != p.File
+}
+
+// Debugger is the DebugHook behind 'sigmo debug' and (break). It stops at
+// breakpoints and while stepping, and then reads commands to step, show the
+// forms being evaluated and the contexts they are evaluated in, or evaluate
+// expressions in a paused frame. See 'help' when stopped.
+//
+// The debugger keeps a single stack of the lists being evaluated, so forms
+// run by spawned tasks are mixed in with those of the task that stopped.
+type Debugger struct {
+	mu     sync.Mutex
+	editor *lineEditor
+	out    io.Writer
+	breaks []breakpoint
+	stack  []debugFrame
+	mode   int
+	// depth is the stack depth 'next' and 'finish' stop at
+	depth int
+	// frame is the frame selected by 'up' and 'down', counting out from
+	// the innermost
+	frame      int
+	last       string
+	evaluating int32
+	sources    map[string][]string
+}
+
+// NewDebugger returns a debugger reading commands from in and writing to
+// out. Reading from a terminal gives it the same line editing as the REPL.
+func NewDebugger(in io.Reader, out io.Writer) *Debugger {
+	d := &Debugger{out: out, sources: make(map[string][]string)}
+	if in == os.Stdin && out == os.Stdout {
+		d.editor = newLineEditor("")
+	} else {
+		d.editor = &lineEditor{in: bufio.NewReader(in), out: out}
+	}
+	return d
+}
+
+// Break adds a breakpoint, given as 'file:line' or the name of a function
+// to stop at the calls of.
+func (d *Debugger) Break(spec string) error {
+	spec = strings.TrimSpace(spec)
+	if i := strings.LastIndex(spec, ":"); i > 0 {
+		line, err := strconv.Atoi(spec[i+1:])
+		if err != nil || line < 1 {
+			return fmt.Errorf("Invalid breakpoint line '%s'", spec[i+1:])
+		}
+		d.breaks = append(d.breaks, breakpoint{file: filepath.Clean(spec[:i]), line: line})
+		return nil
+	}
+	if spec == "" || strings.ContainsAny(spec, " ()[]{}\"") {
+		return fmt.Errorf("Invalid breakpoint '%s'", spec)
+	}
+	d.breaks = append(d.breaks, breakpoint{name: spec})
+	return nil
+}
+
+// Step makes the debugger stop at the next list evaluated.
+func (d *Debugger) Step() {
+	d.mode = debugStep
+}
+
+func (d *Debugger) Enter(form *List, c Context) Value {
+	if atomic.LoadInt32(&d.evaluating) == 1 {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mode == debugQuit {
+		return Atom{t: "error", value: "Stopped by the debugger"}
+	}
+	var parent *List
+	if len(d.stack) > 0 {
+		parent = d.stack[len(d.stack)-1].form
+	}
+	d.stack = append(d.stack, debugFrame{form, c})
+	reason := ""
+	for i, b := range d.breaks {
+		if b.matches(form, parent) {
+			reason = fmt.Sprintf("Breakpoint %d, ", i+1)
+			break
+		}
+	}
+	if reason == "" && d.mode != debugStep && (d.mode != debugNext || len(d.stack) > d.depth) {
+		return nil
+	}
+	if v := d.pause(reason); v != nil {
+		d.stack = d.stack[:len(d.stack)-1]
+		return v
+	}
+	return nil
+}
+
+func (d *Debugger) Leave(form *List, c Context, result Value) {
+	if atomic.LoadInt32(&d.evaluating) == 1 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// when (break) installed the debugger, the lists it was inside of were
+	// never entered
+	n := len(d.stack)
+	if n == 0 || d.stack[n-1].form != form {
+		return
+	}
+	d.stack = d.stack[:n-1]
+	if d.mode == debugFinish && n <= d.depth {
+		fmt.Fprintf(d.out, "%s returned %s\n", clip(form.String(), 40), clip(result.String(), 60))
+		if len(d.stack) > 0 {
+			d.pause("")
+		} else {
+			d.mode = debugStep
+		}
+	}
+}
+
+func breakFunction(input *List, c Context) Value {
+	d, ok := currentHook().(*Debugger)
+	if ok && atomic.LoadInt32(&d.evaluating) == 1 {
+		return NIL
+	}
+	if !ok {
+		d = NewDebugger(os.Stdin, os.Stdout)
+		SetDebugHook(d)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.stack) == 0 {
+		d.stack = append(d.stack, debugFrame{nil, c})
+		defer func() { d.stack = d.stack[:0] }()
+	}
+	if v := d.pause("(break) "); v != nil {
+		return v
+	}
+	return NIL
+}
+
+func clip(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > n {
+		return s[:n-3] + "..."
+	}
+	return s
+}
+
+func (d *Debugger) selected() debugFrame {
+	return d.stack[len(d.stack)-1-d.frame]
+}
+
+func (d *Debugger) describe(f debugFrame) string {
+	if f.form == nil {
+		return "(break)"
+	}
+	where := "?"
+	if f.form.pos.IsValid() {
+		where = f.form.pos.String()
+	}
+	return fmt.Sprintf("%s %s", where, clip(f.form.String(), 60))
+}
+
+// show prints the selected frame along with its line of source.
+func (d *Debugger) show() {
+	f := d.selected()
+	fmt.Fprintf(d.out, "#%d %s\n", d.frame, d.describe(f))
+	if f.form == nil || !f.form.pos.IsValid() {
+		return
+	}
+	p := f.form.pos
+	lines, ok := d.sources[p.File]
+	if !ok {
+		if data, err := ioutil.ReadFile(p.File); err == nil {
+			lines = strings.Split(string(data), "\n")
+		}
+		d.sources[p.File] = lines
+	}
+	if p.Line <= len(lines) {
+		fmt.Fprintf(d.out, "%4d | %s\n", p.Line, lines[p.Line-1])
+	}
+}
+
+func isBuiltinValue(v Value) bool {
+	switch x := v.(type) {
+	case Function:
+		return x.source == nil
+	case Macro:
+		return x.source == nil
+	}
+	return false
+}
+
+// locals prints the bindings in each context from c out to the top level,
+// where only the names are given. Builtins are left out, including the
+// copies lambdas take of them along with the rest of their closures.
+func (d *Debugger) locals(c Context) {
+	var root Context = c
+	for x, ok := root.(*context); ok && x.parent != nil; x, ok = root.(*context) {
+		root = x.parent
+	}
+	x, _ := c.(*context)
+	for i := 0; x != nil; i++ {
+		parent, _ := x.parent.(*context)
+		x.mu.RLock()
+		names := []string{}
+		for name, v := range x.scope {
+			if isBuiltinValue(v) && (parent == nil || isBuiltinValue(root.Get(name))) {
+				continue
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if parent == nil {
+			fmt.Fprintf(d.out, "top level: %s\n", strings.Join(names, " "))
+		} else {
+			fmt.Fprintf(d.out, "context %d:\n", i)
+			for _, name := range names {
+				fmt.Fprintf(d.out, "  %s = %s\n", name, clip(x.scope[name].String(), 60))
+			}
+		}
+		x.mu.RUnlock()
+		x = parent
+	}
+}
+
+func (d *Debugger) eval(src string, c Context) {
+	nodes, err := ParseFile("<debug>", src)
+	if err != nil {
+		fmt.Fprintln(d.out, "error:", err)
+		return
+	}
+	atomic.StoreInt32(&d.evaluating, 1)
+	defer atomic.StoreInt32(&d.evaluating, 0)
+	for _, n := range nodes {
+		v := n.Eval(c)
+		if v.Type() == "error" {
+			fmt.Fprintln(d.out, "error:", v.Value())
+			return
+		}
+		fmt.Fprintln(d.out, v)
+	}
+}
+
+const debugHelp = `  s, step             stop at the next list evaluated
+  n, next             stop at the next list in this frame or out of it
+  f, finish           run until this frame returns
+  c, continue         run until a breakpoint
+  b, break [spec]     list breakpoints, or add one at file:line or a function name
+  d, delete n         delete breakpoint n
+  bt, where [n]       show the innermost n frames being evaluated (20)
+  up, down            select the frame out from or in to the selected one
+  l, locals           show the contexts of the selected frame
+  p, print expr       evaluate expr in the selected frame, as is any other input
+  q, quit             stop the program
+  Enter repeats the last command.`
+
+// pause reads commands until one resumes evaluation, returning an error
+// value to stop with, or nil. It is called with d.mu held.
+func (d *Debugger) pause(reason string) Value {
+	d.frame = 0
+	f := d.selected()
+	if f.form != nil && f.form.pos.IsValid() {
+		fmt.Fprintf(d.out, "%sstopped at %s\n", reason, f.form.pos)
+	} else if reason != "" {
+		fmt.Fprintln(d.out, strings.TrimSuffix(reason, " "))
+	}
+	d.show()
+	for {
+		line, err := d.editor.ReadLine("debug> ")
+		if err == errInterrupt {
+			continue
+		}
+		if err != nil {
+			// without any more input, let the program run to the end
+			d.breaks, d.mode = nil, debugContinue
+			return nil
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			line = d.last
+		}
+		d.last = line
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		arg := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+		depth := len(d.stack) - d.frame
+		switch fields[0] {
+		case "s", "step":
+			d.mode = debugStep
+			return nil
+		case "n", "next":
+			d.mode, d.depth = debugNext, depth
+			return nil
+		case "f", "finish":
+			d.mode, d.depth = debugFinish, depth
+			return nil
+		case "c", "continue":
+			d.mode = debugContinue
+			return nil
+		case "q", "quit":
+			d.mode = debugQuit
+			return Atom{t: "error", value: "Stopped by the debugger"}
+		case "b", "break":
+			if arg != "" {
+				if err := d.Break(arg); err != nil {
+					fmt.Fprintln(d.out, "error:", err)
+				}
+				continue
+			}
+			for i, b := range d.breaks {
+				fmt.Fprintf(d.out, "%d %s\n", i+1, b)
+			}
+		case "d", "delete":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 || n > len(d.breaks) {
+				fmt.Fprintf(d.out, "error: No breakpoint '%s'\n", arg)
+				continue
+			}
+			d.breaks = append(d.breaks[:n-1], d.breaks[n:]...)
+		case "bt", "where":
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				n = 20
+			}
+			for i := 0; i < len(d.stack) && i < n; i++ {
+				mark := " "
+				if i == d.frame {
+					mark = ">"
+				}
+				fmt.Fprintf(d.out, "%s #%d %s\n", mark, i, d.describe(d.stack[len(d.stack)-1-i]))
+			}
+			if len(d.stack) > n {
+				fmt.Fprintf(d.out, "  ... %d more\n", len(d.stack)-n)
+			}
+		case "up", "down":
+			if fields[0] == "up" && d.frame < len(d.stack)-1 {
+				d.frame++
+			} else if fields[0] == "down" && d.frame > 0 {
+				d.frame--
+			}
+			d.show()
+		case "l", "locals":
+			d.locals(d.selected().c)
+		case "h", "help":
+			fmt.Fprintln(d.out, debugHelp)
+		case "p", "print":
+			d.eval(arg, d.selected().c)
+		default:
+			d.eval(line, d.selected().c)
+		}
+	}
+}
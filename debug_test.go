@@ -0,0 +1,137 @@
+package sigmo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const debugProgram = `(def sq (lambda (x)
+  (* x x)))
+(def total (+ (sq 2) (sq 3)))
+`
+
+// debugRun evaluates debugProgram, written to a file so that the debugger
+// can show its lines, stopping at the breakpoints given and reading the
+// commands from input. It returns the value of the last form and what the
+// debugger wrote, with the program's path replaced by "prog.mo".
+func debugRun(t *testing.T, breaks []string, input string) (Value, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sigmo-debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "prog.mo")
+	if err := ioutil.WriteFile(path, []byte(debugProgram), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	d := NewDebugger(strings.NewReader(input), &out)
+	for _, b := range breaks {
+		if err := d.Break(strings.Replace(b, "prog.mo", path, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prev := currentHook()
+	SetDebugHook(d)
+	defer SetDebugHook(prev)
+	nodes, err := ParseFile(path, debugProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewContext(nil)
+	var last Value = NIL
+	for _, n := range nodes {
+		if last = n.Eval(c); last.Type() == "error" {
+			break
+		}
+	}
+	return last, strings.Replace(out.String(), path, "prog.mo", -1)
+}
+
+func TestDebugger(t *testing.T) {
+	v, out := debugRun(t, []string{"prog.mo:2"}, "p x\nl\nbt 2\nc\n(* x 10)\nd 1\nc\n")
+	if v.String() != "13" {
+		t.Errorf("program returned %s, want 13", v)
+	}
+	want := `Breakpoint 1, stopped at prog.mo:2:3
+#0 prog.mo:2:3 (* x x)
+   2 |   (* x x)))
+2
+context 0:
+  x = 2
+top level: sq
+> #0 prog.mo:2:3 (* x x)
+  #1 prog.mo:3:15 (sq 2)
+  ... 2 more
+Breakpoint 1, stopped at prog.mo:2:3
+#0 prog.mo:2:3 (* x x)
+   2 |   (* x x)))
+30
+`
+	if out != want {
+		t.Errorf("debugger wrote:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestDebuggerStepping(t *testing.T) {
+	_, out := debugRun(t, []string{"sq"}, "s\ns\nf\nb\nq\n")
+	want := `Breakpoint 1, stopped at prog.mo:3:15
+#0 prog.mo:3:15 (sq 2)
+   3 | (def total (+ (sq 2) (sq 3)))
+stopped at prog.mo:2:3
+#0 prog.mo:2:3 (* x x)
+   2 |   (* x x)))
+Breakpoint 1, stopped at prog.mo:3:22
+#0 prog.mo:3:22 (sq 3)
+   3 | (def total (+ (sq 2) (sq 3)))
+(sq 3) returned 9
+stopped at prog.mo:3:12
+#0 prog.mo:3:12 (+ (sq 2) (sq 3))
+   3 | (def total (+ (sq 2) (sq 3)))
+1 sq
+`
+	if out != want {
+		t.Errorf("debugger wrote:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestDebuggerQuit(t *testing.T) {
+	v, _ := debugRun(t, []string{"sq"}, "q\n")
+	if v.Type() != "error" || v.Value() != "Stopped by the debugger" {
+		t.Errorf("program returned %s, want the debugger to stop it", v)
+	}
+	v, _ = debugRun(t, []string{"sq"}, "")
+	if v.String() != "13" {
+		t.Errorf("program returned %s without debugger input, want 13", v)
+	}
+}
+
+func TestBreakpointSpecs(t *testing.T) {
+	d := NewDebugger(strings.NewReader(""), ioutil.Discard)
+	for _, tc := range []struct {
+		spec string
+		want string
+	}{
+		{"prog.mo:3", ""},
+		{"sq", ""},
+		{"ns/sq", ""},
+		{"prog.mo:0", "Invalid breakpoint line '0'"},
+		{"prog.mo:x", "Invalid breakpoint line 'x'"},
+		{"(sq 2)", "Invalid breakpoint '(sq 2)'"},
+		{" ", "Invalid breakpoint ''"},
+	} {
+		err := d.Break(tc.spec)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tc.want {
+			t.Errorf("Break(%q) = %q, want %q", tc.spec, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package sigmo
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const maxHistory = 1000
+
+var errInterrupt = errors.New("interrupted")
+
+// lineEditor reads lines from the terminal with emacs-style editing keys and
+// history. When stdin is not a terminal it just reads plain lines.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	fd       int
+	tty      bool
+	history  []string
+	histFile string
+	complete func(string) (string, []string)
+}
+
+func newLineEditor(histFile string) *lineEditor {
+	e := &lineEditor{
+		in:       bufio.NewReader(os.Stdin),
+		out:      os.Stdout,
+		fd:       int(os.Stdin.Fd()),
+		histFile: histFile,
+	}
+	e.tty = isTerminal(e.fd) && isTerminal(int(os.Stdout.Fd()))
+	if data, err := ioutil.ReadFile(histFile); err == nil {
+		for _, l := range strings.Split(string(data), "\n") {
+			if l != "" {
+				e.history = append(e.history, l)
+			}
+		}
+		if len(e.history) > maxHistory {
+			e.history = e.history[len(e.history)-maxHistory:]
+		}
+	}
+	return e
+}
+
+// historyJoiner joins the lines of multi-line input, leaving any other
+// whitespace as it was typed, since it may be inside a string.
+var historyJoiner = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+
+// AddHistory records an entry, joining multi-line input into one line, and
+// appends it to the history file.
+func (e *lineEditor) AddHistory(entry string) {
+	entry = historyJoiner.Replace(strings.TrimSpace(entry))
+	if entry == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == entry) {
+		return
+	}
+	e.history = append(e.history, entry)
+	if len(e.history) > maxHistory {
+		e.history = e.history[1:]
+	}
+	if e.histFile == "" {
+		return
+	}
+	if f, err := os.OpenFile(e.histFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err == nil {
+		fmt.Fprintln(f, entry)
+		f.Close()
+	}
+}
+
+// ReadLine reads one line of input. It returns errInterrupt on Ctrl-C and
+// io.EOF on Ctrl-D at an empty line.
+func (e *lineEditor) ReadLine(prompt string) (string, error) {
+	if !e.tty {
+		line, err := e.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	buf, pos := []rune{}, 0
+	h, saved := len(e.history), ""
+	refresh := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(buf))
+		if n := len(buf) - pos; n > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", n)
+		}
+	}
+	recall := func(i int) {
+		if i < 0 || i > len(e.history) {
+			return
+		}
+		if h == len(e.history) {
+			saved = string(buf)
+		}
+		h = i
+		if h == len(e.history) {
+			buf = []rune(saved)
+		} else {
+			buf = []rune(e.history[h])
+		}
+		pos = len(buf)
+	}
+	refresh()
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(buf), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupt
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+			}
+		case 127, 8: // backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(buf)
+		case 2: // Ctrl-B
+			if pos > 0 {
+				pos--
+			}
+		case 6: // Ctrl-F
+			if pos < len(buf) {
+				pos++
+			}
+		case 11: // Ctrl-K
+			buf = buf[:pos]
+		case 21: // Ctrl-U
+			buf, pos = buf[pos:], 0
+		case '\t':
+			if e.complete == nil {
+				break
+			}
+			word, matches := e.complete(string(buf[:pos]))
+			if len(matches) == 0 {
+				fmt.Fprint(e.out, "\a")
+				break
+			}
+			if prefix := []rune(commonPrefix(matches)); len(prefix) > len([]rune(word)) {
+				start := pos - len([]rune(word))
+				buf = append(append(append([]rune{}, buf[:start]...), prefix...), buf[pos:]...)
+				pos = start + len(prefix)
+			} else if len(matches) > 1 {
+				fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(matches, "  "))
+			}
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case 16: // Ctrl-P
+			recall(h - 1)
+		case 14: // Ctrl-N
+			recall(h + 1)
+		case 27:
+			switch e.escape() {
+			case "A":
+				recall(h - 1)
+			case "B":
+				recall(h + 1)
+			case "C":
+				if pos < len(buf) {
+					pos++
+				}
+			case "D":
+				if pos > 0 {
+					pos--
+				}
+			case "H", "1~", "7~":
+				pos = 0
+			case "F", "4~", "8~":
+				pos = len(buf)
+			case "3~":
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if r >= ' ' {
+				buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+				pos++
+			}
+		}
+		refresh()
+	}
+}
+
+// escape reads the rest of an escape sequence such as "\x1b[A" or "\x1b[3~",
+// returning the part after the "[" or "O".
+func (e *lineEditor) escape() string {
+	r, _, err := e.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return ""
+	}
+	seq := []rune{}
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, r)
+		if r < '0' || r > '9' {
+			return string(seq)
+		}
+	}
+}
+
+// color wraps s in an ANSI color code, unless output is not a terminal or
+// NO_COLOR is set.
+func (e *lineEditor) color(s string, code string) string {
+	if !e.tty || os.Getenv("NO_COLOR") != "" {
+		return s
+	}
+	return "\x1b[" + code + "m" + s + "\x1b[0m"
+}
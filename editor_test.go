@@ -0,0 +1,59 @@
+package sigmo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHistoryKeepsWhitespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sigmo-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "history")
+
+	e := newLineEditor(file)
+	e.AddHistory(`(split s "  ")`)
+	e.AddHistory("(defn f (x)\n  (cat x \"a\tb\"))\n")
+	e.AddHistory("(split s \"  \")\r\n")
+	e.AddHistory("   \n")
+	want := []string{`(split s "  ")`, "(defn f (x)   (cat x \"a\tb\"))", `(split s "  ")`}
+
+	for _, h := range [][]string{e.history, newLineEditor(file).history} {
+		if len(h) != len(want) {
+			t.Fatalf("history is %q, want %q", h, want)
+		}
+		for i := range want {
+			if h[i] != want[i] {
+				t.Errorf("history entry %d is %q, want %q", i, h[i], want[i])
+			}
+		}
+	}
+}
+
+func TestIncomplete(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want bool
+	}{
+		{`(+ 1 2)`, false},
+		{`(+ 1`, true},
+		{`(def s "abc`, true},
+		{`(def s "a)b")`, false},
+		{`{"a" (1 2)`, true},
+		{`"""raw ( string`, true},
+		{`"""raw ( string"""`, false},
+		{`#| comment ( |# 1`, false},
+		{`#| comment`, true},
+		{`(+ 1 2))`, false},
+		{`; (`, false},
+		{`'`, true},
+	} {
+		if got := Incomplete(tc.src); got != tc.want {
+			t.Errorf("Incomplete(%q) = %v, want %v", tc.src, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package sigmo
+
+import (
+	"fmt"
+	"strings"
+)
+
+type NodeKind int
+
+const (
+	NodeAtom NodeKind = iota
+	NodeComment
+	NodeList
+)
+
+// Node is a concrete syntax tree node. Unlike the values produced by Parse,
+// nodes keep comments, the brackets used and where lines were broken, so
+// that source can be written back out.
+type Node struct {
+	Kind NodeKind
+	// Text is the source of an atom or comment, or the opening bracket of
+	// a list with any prefix glued to it: "(", "'(", "[", "{", "'{", or a
+	// reader macro's "#name(" or "#name{".
+	Text     string
+	Children []*Node
+	Pos      Pos
+	End      Pos
+	// NewlineBefore and BlankBefore are set when the node started on a new
+	// line, or after a blank line, in the source.
+	NewlineBefore bool
+	BlankBefore   bool
+}
+
+var closers = map[byte]string{'(': ")", '[': "]", '{': "}"}
+
+func (n *Node) Close() string {
+	return closers[n.Text[len(n.Text)-1]]
+}
+
+// IsLineComment reports whether n is a comment running to the end of its
+// line, rather than a '#| |#' block.
+func (n *Node) IsLineComment() bool {
+	return n.Kind == NodeComment && strings.HasPrefix(n.Text, ";")
+}
+
+// opener returns the length of the opening bracket, with its prefix, that
+// runes start with, or 0 if they don't start with one.
+func opener(runes []rune) int {
+	i := 0
+	if len(runes) > 1 && runes[0] == '\'' {
+		i = 1
+	} else if len(runes) > 1 && runes[0] == '#' && runes[1] != '\\' {
+		for i = 1; i < len(runes) && !strings.ContainsRune(" \t\r\n;()[]{}\"", runes[i]); i++ {
+		}
+		if !isIdentifier(string(runes[1:i])) {
+			return 0
+		}
+	}
+	if i < len(runes) && strings.ContainsRune("([{", runes[i]) && (i == 0 || runes[i] != '[') {
+		return i + 1
+	}
+	return 0
+}
+
+// ParseCST parses src into a concrete syntax tree. When src doesn't parse,
+// the nodes up to the error are returned along with it, with any lists left
+// open ending where it stopped.
+func ParseCST(file string, src string) ([]*Node, error) {
+	root := &Node{Kind: NodeList}
+	stack := []*Node{root}
+	runes := []rune(src)
+	line, col, newlines := 1, 1, 0
+	pos := func() Pos { return Pos{File: file, Line: line, Col: col} }
+	advance := func(n int) string {
+		s := string(runes[:n])
+		for _, r := range runes[:n] {
+			if r == '\n' {
+				line++
+				col = 1
+			} else {
+				col++
+			}
+		}
+		runes = runes[n:]
+		return s
+	}
+	fail := func(err error) ([]*Node, error) {
+		for _, n := range stack[1:] {
+			n.End = pos()
+		}
+		return root.Children, err
+	}
+	add := func(n *Node) {
+		n.NewlineBefore, n.BlankBefore = newlines > 0, newlines > 1
+		newlines = 0
+		top := stack[len(stack)-1]
+		top.Children = append(top.Children, n)
+	}
+	for len(runes) > 0 {
+		r := runes[0]
+		switch {
+		case r == '\n':
+			newlines++
+			advance(1)
+		case r == ' ' || r == '\t' || r == '\r':
+			advance(1)
+		case r == ';':
+			n := &Node{Kind: NodeComment, Pos: pos()}
+			i := 0
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			n.Text = strings.TrimRight(advance(i), " \t\r")
+			n.End = pos()
+			add(n)
+		case r == '#' && len(runes) > 1 && runes[1] == '|':
+			n := &Node{Kind: NodeComment, Pos: pos()}
+			i, depth, last := 2, 1, rune(0)
+			for ; i < len(runes) && depth > 0; i++ {
+				c := runes[i]
+				if last == '#' && c == '|' {
+					depth++
+					c = 0
+				} else if last == '|' && c == '#' {
+					depth--
+					c = 0
+				}
+				last = c
+			}
+			if depth > 0 {
+				return fail(fmt.Errorf("%s: Unclosed '#|'", n.Pos))
+			}
+			n.Text = advance(i)
+			n.End = pos()
+			add(n)
+		case opener(runes) > 0:
+			n := &Node{Kind: NodeList, Pos: pos()}
+			n.Text = advance(opener(runes))
+			add(n)
+			stack = append(stack, n)
+		case r == ')' || r == ']' || r == '}':
+			top := stack[len(stack)-1]
+			if len(stack) == 1 || top.Close() != string(r) {
+				return fail(fmt.Errorf("%s: Unexpected token '%c'", pos(), r))
+			}
+			advance(1)
+			top.End = pos()
+			stack = stack[:len(stack)-1]
+			newlines = 0
+		default:
+			n := &Node{Kind: NodeAtom, Pos: pos()}
+			i, inString := 0, false
+			if len(runes) > 2 && runes[0] == '#' && runes[1] == '\\' {
+				// the character named may be one that would end the atom
+				i = 3
+			}
+			for ; i < len(runes); i++ {
+				c := runes[i]
+				if !inString && c == '"' && i+2 < len(runes) && runes[i+1] == '"' && runes[i+2] == '"' {
+					end := strings.Index(string(runes[i+3:]), `"""`)
+					if end < 0 {
+						return fail(fmt.Errorf("%s: Unterminated string", n.Pos))
+					}
+					i += 3 + len([]rune(string(runes[i+3:])[:end])) + 2
+					continue
+				}
+				if inString {
+					if c == '\\' {
+						i++
+					} else if c == '"' {
+						inString = false
+					}
+					continue
+				}
+				if c == '"' {
+					inString = true
+				} else if strings.ContainsRune(" \t\r\n;()[]{}", c) {
+					break
+				}
+			}
+			if inString {
+				return fail(fmt.Errorf("%s: Unterminated string", n.Pos))
+			}
+			n.Text = advance(i)
+			n.End = pos()
+			add(n)
+		}
+	}
+	if len(stack) > 1 {
+		top := stack[len(stack)-1]
+		return fail(fmt.Errorf("%s: Unclosed '%s'", top.Pos, top.Text))
+	}
+	return root.Children, nil
+}
+
+// indentForms gives the number of arguments forms take before their body.
+// Lines in the body are indented by two columns, and those arguments by
+// four when they are put on a line of their own.
+var indentForms = map[string]int{
+	"def":        1,
+	"defn":       2,
+	"macro":      2,
+	"lambda":     1,
+	"let":        1,
+	"for":        1,
+	"if":         1,
+	"while":      1,
+	"cond":       0,
+	"do":         0,
+	"select":     0,
+	"time-it":    0,
+	"profile":    1,
+	"namespace":  1,
+	"defgeneric": 2,
+	"defmethod":  2,
+	"deftype":    1,
+}
+
+// bindingForms gives the argument of forms that is a list of bindings or
+// parameters, which is aligned under its first element rather than indented
+// like a call.
+var bindingForms = map[string]int{
+	"let":        1,
+	"for":        1,
+	"lambda":     1,
+	"defn":       2,
+	"macro":      2,
+	"defgeneric": 2,
+	"defmethod":  2,
+	"defreader":  2,
+}
+
+// Format rewrites src with its comments kept and its lines indented the
+// canonical way. Line breaks are kept where the source has them, except that
+// closing brackets are moved onto the end of the line before, and runs of
+// blank lines are collapsed into one.
+func Format(file string, src string) (string, error) {
+	nodes, err := ParseCST(file, src)
+	if err != nil {
+		return "", err
+	}
+	p := &printer{}
+	for i, n := range nodes {
+		if i > 0 {
+			switch {
+			case n.BlankBefore:
+				p.write("\n\n")
+			case n.NewlineBefore || nodes[i-1].IsLineComment():
+				p.write("\n")
+			default:
+				p.write(" ")
+			}
+		}
+		p.node(n)
+	}
+	if len(nodes) > 0 {
+		p.write("\n")
+	}
+	return p.String(), nil
+}
+
+type printer struct {
+	strings.Builder
+	col int
+}
+
+func (p *printer) write(s string) {
+	p.WriteString(s)
+	if i := strings.LastIndex(s, "\n"); i >= 0 {
+		p.col = len([]rune(s[i+1:]))
+	} else {
+		p.col += len([]rune(s))
+	}
+}
+
+func (p *printer) newline(indent int, blank bool) {
+	if blank {
+		p.write("\n")
+	}
+	p.write("\n" + strings.Repeat(" ", indent))
+}
+
+func (p *printer) node(n *Node) {
+	p.list(n, false)
+}
+
+// list writes n, with its elements aligned under the first if it is a list
+// of bindings, or else indented as a call when it starts with an atom.
+func (p *printer) list(n *Node, bindings bool) {
+	if n.Kind != NodeList {
+		p.write(n.Text)
+		return
+	}
+	col := p.col
+	p.write(n.Text)
+	special, align, inner := -1, col+len(n.Text), -1
+	if len(n.Children) > 0 && n.Text == "(" && n.Children[0].Kind == NodeAtom && !bindings {
+		head := n.Children[0]
+		if s, ok := indentForms[head.Text]; ok {
+			special = s
+		} else if len(n.Children) > 1 && !n.Children[1].NewlineBefore && n.Children[1].Kind != NodeComment {
+			align += len([]rune(head.Text)) + 1
+		}
+		if b, ok := bindingForms[head.Text]; ok {
+			inner = b
+		}
+	}
+	for i, c := range n.Children {
+		if i > 0 {
+			if c.NewlineBefore || n.Children[i-1].IsLineComment() {
+				indent := align
+				if special >= 0 {
+					indent = col + 2
+					if i <= special {
+						indent = col + 4
+					}
+				}
+				p.newline(indent, c.BlankBefore)
+			} else {
+				p.write(" ")
+			}
+		} else if c.Kind == NodeComment && c.NewlineBefore {
+			p.newline(align, false)
+		}
+		p.list(c, i == inner)
+	}
+	if len(n.Children) > 0 && n.Children[len(n.Children)-1].IsLineComment() {
+		p.newline(align, false)
+	}
+	p.write(n.Close())
+}
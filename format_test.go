@@ -0,0 +1,54 @@
+package sigmo
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{"(let (x 1\ny 2)\n(+ x y))", "(let (x 1\n      y 2)\n  (+ x y))\n"},
+		{"(for (x\nxs)\n(println x))", "(for (x\n      xs)\n  (println x))\n"},
+		{"(defn f (a\nb)\n(+ a\nb))", "(defn f (a\n         b)\n  (+ a\n     b))\n"},
+		{"(foo (x 1\ny 2))", "(foo (x 1\n        y 2))\n"},
+		{"(if (> x 1)\n:big\n:small)", "(if (> x 1)\n  :big\n  :small)\n"},
+		{"(def x 1)\n\n\n\n(def y 2)", "(def x 1)\n\n(def y 2)\n"},
+		{"(do ; first\n1\n)", "(do ; first\n  1)\n"},
+		{"(+ 1 #| two |# 2)", "(+ 1 #| two |# 2)\n"},
+	} {
+		got, err := Format("<test>", tc.src)
+		if err != nil {
+			t.Errorf("%q: %v", tc.src, err)
+		} else if got != tc.want {
+			t.Errorf("%q formatted as\n%s\nwant\n%s", tc.src, got, tc.want)
+		}
+	}
+}
+
+// TestFormatIdempotent formats each example twice, which should change
+// nothing the second time.
+func TestFormatIdempotent(t *testing.T) {
+	files, _ := filepath.Glob("examples/*.mo")
+	if len(files) == 0 {
+		t.Skip("no examples")
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		once, err := Format(f, string(data))
+		if err != nil {
+			t.Errorf("%s: %v", f, err)
+			continue
+		}
+		twice, err := Format(f, once)
+		if err != nil || twice != once {
+			t.Errorf("%s changed when formatted again: %v", f, err)
+		}
+	}
+}
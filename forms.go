@@ -3,8 +3,8 @@ package sigmo
 import (
 	"bufio"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
 type Form func(*List, Context) Value
@@ -12,34 +12,96 @@ type Form func(*List, Context) Value
 var specialForms map[string]Form
 
 func lambdaForm(form *List, c Context) Value {
-	// TODO: not enough args to func
-	copied := c.CopyLocals()
-	return NewFunction("anonymous", "**", func(args *List, outer Context) Value {
+	return newLambda("anonymous", form, c)
+}
+
+// lambdaParts splits a form of '(lambda args [doc] [#type] body)' into its
+// docstring, return type annotation and body.
+func lambdaParts(form *List) (string, string, Value) {
+	doc, ret := "", ""
+	rest := form.children[2:]
+	if len(rest) > 1 && rest[0].Type() == "string" {
+		doc = rest[0].Value().(string)
+		rest = rest[1:]
+	}
+	if len(rest) > 1 && rest[0].Type() == "type" {
+		ret = rest[0].Value().(string)
+		rest = rest[1:]
+	}
+	return doc, ret, rest[0]
+}
+
+func newLambda(name string, form *List, c Context) Value {
+	if len(form.children) < 3 {
+		return Atom{t: "error", value: "Wrong number of arguments to 'lambda'"}
+	}
+	if form.children[1].Type() != "list" {
+		return Atom{t: "error", value: fmt.Sprintf("lambda expected argument 0 of type 'list', got type '%s'", form.children[1].Type())}
+	}
+	return closure(name, form, c.CopyLocals())
+}
+
+// closure returns the function for a lambda form, binding the values in env
+// around each call.
+func closure(name string, form *List, env map[string]Value) Function {
+	doc, ret, body := lambdaParts(form)
+	f := NewFunction(name, "**", func(args *List, outer Context) Value {
 		inner := NewContext(outer)
-		for k, v := range copied {
+		for k, v := range env {
 			inner.Set(k, v.Copy())
 		}
 		// TODO: check this!
 		argnames := form.children[1].(*List)
-		if err := ParseArgs(argnames, args, inner); err != nil {
+		if err := ParseArgs(name, argnames, args, inner); err != nil {
 			return err
 		}
-		return form.children[2].Eval(inner)
+		v := body.Eval(inner)
+		if ret != "" && v.Type() != ret && v.Type() != "error" {
+			return Atom{t: "error", value: fmt.Sprintf("Expected return value of type '%s', got '%s'", ret, v.Type())}
+		}
+		return v
 	})
+	f.doc = doc
+	f.args = form.children[1].(*List)
+	f.source = form
+	f.env = env
+	return f
 }
 
 func defForm(form *List, c Context) Value {
+	doc := ""
+	if len(form.children) == 4 && form.children[2].Type() == "string" {
+		doc = form.children[2].Value().(string)
+		form = &List{children: []Value{form.children[0], form.children[1], form.children[3]}, pos: form.pos}
+	}
 	if len(form.children) != 3 {
 		return Atom{t: "error", value: "Wrong number of arguments to 'def'"}
 	}
 	if form.children[1].Type() != "identifier" {
 		return Atom{t: "error", value: fmt.Sprintf("def expected argument 0 of type 'identifier', got type '%s'", form.children[1].Type())}
 	}
-	v := form.children[2].Eval(c)
+	name := form.children[1].Value().(string)
+	var v Value
+	if l, ok := form.children[2].(*List); ok && isForm(l, "lambda") {
+		v = newLambda(name, l, c)
+	} else {
+		v = form.children[2].Eval(c)
+	}
 	if v.Type() == "error" {
 		return v
 	}
-	c.Set(form.children[1].Value().(string), v)
+	if doc != "" {
+		switch x := v.(type) {
+		case Function:
+			x.doc = doc
+			v = x
+		case Macro:
+			x.doc = doc
+			v = x
+		}
+		c.SetDoc(name, doc)
+	}
+	c.Set(name, v)
 	return v
 }
 
@@ -89,11 +151,15 @@ func forForm(form *List, c Context) Value {
 	ident := params.children[0].Value().(string)
 	inner := NewContext(c)
 	temp := params.children[1].Eval(inner)
-	if temp.Type() != "list" {
-		return Atom{t: "error", value: "Second argument of 'for' parameters must evaluate to a list"}
+	if temp.Type() == "error" {
+		return temp
+	}
+	ls, ok := temp.(Iterable)
+	if !ok {
+		return Atom{t: "error", value: "Second argument of 'for' parameters must evaluate to a list or seq"}
 	}
-	ls := temp.(*List)
-	for _, n := range ls.children {
+	next := ls.Iter()
+	for n, ok := next(); ok; n, ok = next() {
 		x := n.Eval(inner)
 		if x.Type() == "error" {
 			return x
@@ -160,38 +226,64 @@ func macroForm(form *List, c Context) Value {
 	if form.children[2].Type() != "list" {
 		return Atom{t: "error", value: fmt.Sprintf("macro expected argument 1 of type 'list', got type '%s'", form.children[2].Type())}
 	}
+	v := newMacro(name, form)
+	c.Set(name, v)
+	return v
+}
+
+func newMacro(name string, form *List) Macro {
+	doc := ""
+	if len(form.children) > 4 && form.children[3].Type() == "string" {
+		doc = form.children[3].Value().(string)
+	}
 	v := NewMacro(name, "**", func(args *List, outer Context) Value {
-		argnames := form.children[2].(*List)
-		subs := make(map[string]Value)
-		for i, a := range argnames.children {
-			if i >= len(args.children)-1 {
-				return Atom{t: "error", value: fmt.Sprintf("Not enough arguments to macro '%s'. Expected %d, got %d.", name, len(argnames.children), len(args.children)-1)}
-			}
-			if a.Type() == "identifier" {
-				subs[a.Value().(string)] = args.children[i+1]
-			} else if a.Type() == "expansion" {
-				subs[a.Value().(string)] = &List{children: args.children[1+i:]}
-				break
-			}
+		forms, err := expandMacro(form, args)
+		if err != nil {
+			return Atom{t: "error", value: err.Error()}
 		}
-		// error needs to bubble here somewhere
 		var last Value = NIL
-
-		for _, r := range form.children[3:] {
-			p := r.Copy()
-			for _, b := range NestedReplace(p, &subs) {
-				last = b.Eval(outer)
-				if last.Type() == "error" {
-					return last
-				}
+		for _, b := range forms {
+			last = b.Eval(outer)
+			if last.Type() == "error" {
+				return last
 			}
 		}
 		return last
 	})
-	c.Set(name, v)
+	v.doc = doc
+	v.args = form.children[2].(*List)
+	v.source = form
 	return v
 }
 
+// expandMacro substitutes the arguments of call into the body of the macro
+// definition def, returning the resulting forms without evaluating them.
+func expandMacro(def *List, call *List) ([]Value, error) {
+	name := def.children[1].Value().(string)
+	argnames := def.children[2].(*List)
+	body := def.children[3:]
+	if len(body) > 1 && body[0].Type() == "string" {
+		body = body[1:]
+	}
+	subs := make(map[string]Value)
+	for i, a := range argnames.children {
+		if i >= len(call.children)-1 {
+			return nil, fmt.Errorf("Not enough arguments to macro '%s'. Expected %d, got %d.", name, len(argnames.children), len(call.children)-1)
+		}
+		if a.Type() == "identifier" {
+			subs[a.Value().(string)] = call.children[i+1]
+		} else if a.Type() == "expansion" {
+			subs[a.Value().(string)] = &List{children: call.children[1+i:]}
+			break
+		}
+	}
+	forms := []Value{}
+	for _, r := range body {
+		forms = append(forms, nestedReplace(r.Copy(), &subs, call.pos)...)
+	}
+	return forms, nil
+}
+
 //func debugForm(form *List, c Context) Value {
 //fmt.Println("ns", c.ns)
 //fmt.Println("scope", c.scope)
@@ -226,24 +318,32 @@ func namespaceForm(form *List, c Context) Value {
 	return last
 }
 
-// TODO: add an "as" ie (import core/math m) or (import core/math *)
-func importForm(form *List, c Context) Value {
-	var fname string
-	switch form.children[1].Type() {
+func importPath(v Value) (string, error) {
+	switch v.Type() {
 	case "identifier":
-		fname = fmt.Sprintf("%s/%s.mo", os.Getenv("SIGMO_ROOT"), form.children[1].Value().(string))
+		return fmt.Sprintf("%s/%s.mo", os.Getenv("SIGMO_ROOT"), v.Value().(string)), nil
 	case "string":
-		fname = form.children[1].Value().(string)
-	default:
-		return Atom{t: "error", value: fmt.Sprintf("import expected argument 0 of type 'identifier' (namespace) or 'string', got type '%s'", form.children[1].Type())}
+		return v.Value().(string), nil
 	}
-	data, err := ioutil.ReadFile(fname)
-	if err != nil {
-		return Atom{t: "error", value: fmt.Sprintf("error during import of '%s': %v", fname, err)}
+	return "", fmt.Errorf("import expected argument 0 of type 'identifier' (namespace) or 'string', got type '%s'", v.Type())
+}
+
+// resolvePath returns path relative to dir, unless it is absolute or dir is
+// "", when it is relative to the working directory as it is.
+func resolvePath(dir string, path string) string {
+	if dir == "" || filepath.IsAbs(path) {
+		return path
 	}
+	return filepath.Join(dir, path)
+}
 
-	tok := Tokenize(string(data))
-	nodes, err := Parse(tok)
+// TODO: add an "as" ie (import core/math m) or (import core/math *)
+func importForm(form *List, c Context) Value {
+	fname, err := importPath(form.children[1])
+	if err != nil {
+		return Atom{t: "error", value: err.Error()}
+	}
+	nodes, err := readImport(fname)
 	if err != nil {
 		return Atom{t: "error", value: fmt.Sprintf("error during import of '%s': %v", fname, err)}
 	}
@@ -268,6 +368,9 @@ func guardForm(form *List, c Context) Value {
 			if handler.Type() == "function" {
 				args := &List{children: []Value{wrapped}}
 				return handler.(Function).Call(args, c)
+			} else if handler.Type() == "generic" {
+				args := &List{children: []Value{wrapped}}
+				return handler.(*Generic).Call(args, c)
 			} else if handler.Type() == "macro" {
 				args := &List{children: []Value{NIL, wrapped}}
 				return handler.(Macro).Call(args, c)
@@ -297,6 +400,134 @@ func condForm(form *List, c Context) Value {
 	return NIL
 }
 
+func defgenericForm(form *List, c Context) Value {
+	if len(form.children) < 3 || len(form.children) > 4 {
+		return Atom{t: "error", value: "Wrong number of arguments to 'defgeneric'"}
+	}
+	if form.children[1].Type() != "identifier" {
+		return Atom{t: "error", value: fmt.Sprintf("defgeneric expected argument 0 of type 'identifier', got type '%s'", form.children[1].Type())}
+	}
+	if form.children[2].Type() != "list" {
+		return Atom{t: "error", value: fmt.Sprintf("defgeneric expected argument 1 of type 'list', got type '%s'", form.children[2].Type())}
+	}
+	name := form.children[1].Value().(string)
+	g := NewGeneric(name)
+	g.args = form.children[2].(*List)
+	if len(form.children) == 4 {
+		g.fallback = newLambda(name, &List{children: []Value{form.children[0], form.children[2], form.children[3]}, pos: form.pos}, c)
+	}
+	c.Set(name, g)
+	return g
+}
+
+func defmethodForm(form *List, c Context) Value {
+	if len(form.children) != 4 {
+		return Atom{t: "error", value: "Wrong number of arguments to 'defmethod'"}
+	}
+	if form.children[1].Type() != "identifier" {
+		return Atom{t: "error", value: fmt.Sprintf("defmethod expected argument 0 of type 'identifier', got type '%s'", form.children[1].Type())}
+	}
+	if form.children[2].Type() != "list" {
+		return Atom{t: "error", value: fmt.Sprintf("defmethod expected argument 1 of type 'list', got type '%s'", form.children[2].Type())}
+	}
+	name := form.children[1].Value().(string)
+	g := c.Get(name)
+	if g.Type() != "generic" {
+		return Atom{t: "error", value: fmt.Sprintf("Cannot define method on '%s' of type '%s', expected 'generic'", name, g.Type())}
+	}
+	fn := newLambda(name, &List{children: []Value{form.children[0], form.children[2], form.children[3]}, pos: form.pos}, c)
+	if fn.Type() == "error" {
+		return fn
+	}
+	return g.(*Generic).AddMethod(form.children[2].(*List), fn.(Function))
+}
+
+// builtinTypes are the types of the values the interpreter makes itself,
+// which deftype can't define again.
+var builtinTypes = map[string]bool{
+	"int": true, "float": true, "bool": true, "string": true, "char": true,
+	"identifier": true, "symbol": true, "type": true, "nil": true, "error": true,
+	"list": true, "hash": true, "function": true, "macro": true, "generic": true,
+	"seq": true, "chan": true, "future": true, "ref": true, "time": true, "duration": true,
+}
+
+func deftypeForm(form *List, c Context) Value {
+	if len(form.children) != 2 {
+		return Atom{t: "error", value: "Wrong number of arguments to 'deftype'"}
+	}
+	if form.children[1].Type() != "identifier" {
+		return Atom{t: "error", value: fmt.Sprintf("deftype expected argument 0 of type 'identifier', got type '%s'", form.children[1].Type())}
+	}
+	name := form.children[1].Value().(string)
+	if builtinTypes[name] {
+		return Atom{t: "error", value: fmt.Sprintf("Cannot redefine builtin type '%s'", name)}
+	}
+	v := typeConstructor(name, form)
+	c.Set(name, v)
+	return v
+}
+
+func typeConstructor(name string, form *List) Function {
+	v := NewFunction(name, "*", func(args *List, c Context) Value {
+		if args.children[0].Type() == name {
+			return args.children[0]
+		}
+		return &Tagged{t: name, value: args.children[0]}
+	})
+	v.source = form
+	return v
+}
+
+// quoteForm returns its argument without evaluating it, as 'x is read.
+func quoteForm(form *List, c Context) Value {
+	if len(form.children) != 2 {
+		return Atom{t: "error", value: "Wrong number of arguments to 'quote'"}
+	}
+	if l, ok := form.children[1].(*List); ok {
+		q := l.Copy().(*List)
+		q.Quoted = true
+		return q
+	}
+	return form.children[1]
+}
+
+// defreaderForm defines a reader macro, which is given the form read after
+// '#name' and returns the form to evaluate in its place. They are kept in
+// the context under '#name', where no identifier can reach them.
+func defreaderForm(form *List, c Context) Value {
+	if len(form.children) < 4 {
+		return Atom{t: "error", value: "Wrong number of arguments to 'defreader'"}
+	}
+	if form.children[1].Type() != "identifier" {
+		return Atom{t: "error", value: fmt.Sprintf("defreader expected argument 0 of type 'identifier', got type '%s'", form.children[1].Type())}
+	}
+	name := form.children[1].Value().(string)
+	f := newLambda(name, &List{children: append([]Value{form.children[0]}, form.children[2:]...), pos: form.pos}, c)
+	if f.Type() == "error" {
+		return f
+	}
+	c.Set("#"+name, f)
+	return f
+}
+
+// readerMacroForm is what '#name' followed by a form is read as. It gives
+// the form to the reader macro, and evaluates what that returns.
+func readerMacroForm(form *List, c Context) Value {
+	if len(form.children) != 3 || form.children[1].Type() != "identifier" {
+		return Atom{t: "error", value: "Wrong number of arguments to 'reader-macro'"}
+	}
+	name := form.children[1].Value().(string)
+	f, ok := c.Get("#" + name).(Function)
+	if !ok {
+		return Atom{t: "error", value: fmt.Sprintf("Unknown reader macro '#%s'", name)}
+	}
+	v := f.Call(&List{children: []Value{form.children[2]}}, c)
+	if v.Type() == "error" {
+		return v
+	}
+	return v.Eval(c)
+}
+
 func init() {
 	specialForms = map[string]Form{
 		"lambda": lambdaForm,
@@ -310,11 +541,22 @@ func init() {
 		"input":  inputForm,
 		"macro":  macroForm,
 		//"debug":     debugForm,
-		"set!":      setBangForm,
-		"namespace": namespaceForm,
-		"import":    importForm,
-		"guard":     guardForm,
-		"cond":      condForm,
+		"set!":         setBangForm,
+		"namespace":    namespaceForm,
+		"import":       importForm,
+		"guard":        guardForm,
+		"cond":         condForm,
+		"defgeneric":   defgenericForm,
+		"defmethod":    defmethodForm,
+		"deftype":      deftypeForm,
+		"select":       selectForm,
+		"time-it":      timeItForm,
+		"trace":        traceForm,
+		"untrace":      untraceForm,
+		"profile":      profileForm,
+		"quote":        quoteForm,
+		"defreader":    defreaderForm,
+		"reader-macro": readerMacroForm,
 	}
 }
 
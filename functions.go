@@ -8,48 +8,114 @@ import (
 )
 
 var builtins = map[string]Function{
-	"%":           NewFunction("%", "int,int", modFunction),
-	"+":           NewFunction("+", "int|float,+", plusFunction),
-	"-":           NewFunction("-", "int|float,+", minusFunction),
-	"*":           NewFunction("*", "int|float,+", mulFunction),
-	"/":           NewFunction("/", "int|float,int|float", divFunction),
-	"print":       NewFunction("print", "**", printFunction),
-	"println":     NewFunction("println", "**", printlnFunction),
-	"cat":         NewFunction("cat", "string,+", catFunction),
-	"head":        NewFunction("head", "list", headFunction),
-	"tail":        NewFunction("tail", "list", tailFunction),
-	"cons":        NewFunction("cons", "*,*", consFunction),
-	"rev":         NewFunction("rev", "list|string", revFunction),
-	"len":         NewFunction("len", "list|string|hash", lenFunction),
-	"eq":          NewFunction("eq", "*,*", eqFunction),
-	"neq":         NewFunction("neq", "*,*", neqFunction),
-	"and":         NewFunction("and", "bool,+", andFunction),
-	"or":          NewFunction("or", "bool,+", orFunction),
-	"xor":         NewFunction("xor", "bool,+", xorFunction),
-	"not":         NewFunction("not", "bool", notFunction),
-	"lt":          NewFunction("lt", "int|float,int|float", ltFunction),
-	"lte":         NewFunction("lte", "int|float,int|float", lteFunction),
-	"gt":          NewFunction("gt", "int|float,int|float", gtFunction),
-	"gte":         NewFunction("gte", "int|float,int|float", gteFunction),
-	"exec":        NewFunction("exec", "list", execFunction),
-	"eval":        NewFunction("eval", "string", evalFunction),
-	"trim":        NewFunction("trim", "string,string", trimFunction),
-	"join":        NewFunction("join", "list,string", joinFunction),
-	"split":       NewFunction("split", "string,string", splitFunction),
-	"split-n":     NewFunction("split-n", "string,string,int", splitNFunction),
-	"parse-int":   NewFunction("parse-int", "string", parseIntFunction),
-	"parse-float": NewFunction("parse-float", "string", parseFloatFunction),
-	"get":         NewFunction("get", "list,int", getFunction),
-	"hget":        NewFunction("hget", "hash,string|symbol", hgetFunction),
-	"hset!":       NewFunction("hset!", "hash,string|symbol,*", hsetBangFunction),
-	"hcontains":   NewFunction("hcontains", "hash,string|symbol", hcontainsFunction),
-	"type":        NewFunction("type", "*", typeFunction),
-	"int":         NewFunction("int", "*", intFunction),
-	"float":       NewFunction("float", "*", floatFunction),
-	"string":      NewFunction("string", "*", stringFunction),
-	"bool":        NewFunction("bool", "*", boolFunction),
-	"floor":       NewFunction("floor", "float", floorFunction),
-	"ceil":        NewFunction("ceil", "float", ceilFunction),
+	"%":                NewFunction("%", "int,int", modFunction).returns("int"),
+	"+":                NewFunction("+", "int|float,+", plusFunction).returns("int|float"),
+	"-":                NewFunction("-", "int|float,+", minusFunction).returns("int|float"),
+	"*":                NewFunction("*", "int|float,+", mulFunction).returns("int|float"),
+	"/":                NewFunction("/", "int|float,int|float", divFunction).returns("int|float"),
+	"print":            NewFunction("print", "**", printFunction).returns("nil"),
+	"println":          NewFunction("println", "**", printlnFunction).returns("nil"),
+	"pprint":           NewFunction("pprint", "*,**", pprintFunction).returns("nil"),
+	"cat":              NewFunction("cat", "string,+", catFunction).returns("string"),
+	"head":             NewFunction("head", "list", headFunction),
+	"tail":             NewFunction("tail", "list", tailFunction).returns("list"),
+	"cons":             NewFunction("cons", "*,*", consFunction).returns("list"),
+	"rev":              NewFunction("rev", "list|string", revFunction).returns("list"),
+	"len":              NewFunction("len", "list|string|hash|seq", lenFunction).returns("int"),
+	"eq":               NewFunction("eq", "*,*", eqFunction).returns("bool"),
+	"neq":              NewFunction("neq", "*,*", neqFunction).returns("bool"),
+	"and":              NewFunction("and", "bool,+", andFunction).returns("bool"),
+	"or":               NewFunction("or", "bool,+", orFunction).returns("bool"),
+	"xor":              NewFunction("xor", "bool,+", xorFunction).returns("bool"),
+	"not":              NewFunction("not", "bool", notFunction).returns("bool"),
+	"lt":               NewFunction("lt", "int|float,int|float", ltFunction).returns("bool"),
+	"lte":              NewFunction("lte", "int|float,int|float", lteFunction).returns("bool"),
+	"gt":               NewFunction("gt", "int|float,int|float", gtFunction).returns("bool"),
+	"gte":              NewFunction("gte", "int|float,int|float", gteFunction).returns("bool"),
+	"exec":             NewFunction("exec", "list", execFunction),
+	"eval":             NewFunction("eval", "*", evalFunction),
+	"symbol":           NewFunction("symbol", "string|symbol|identifier", symbolFunction).returns("identifier"),
+	"keyword":          NewFunction("keyword", "string|symbol|identifier", keywordFunction).returns("symbol"),
+	"name":             NewFunction("name", "string|symbol|identifier", nameFunction).returns("string"),
+	"identifier?":      NewFunction("identifier?", "*", isIdentifierFunction).returns("bool"),
+	"trim":             NewFunction("trim", "string,string", trimFunction).returns("string"),
+	"join":             NewFunction("join", "list,string", joinFunction).returns("string"),
+	"split":            NewFunction("split", "string,string", splitFunction).returns("list"),
+	"split-n":          NewFunction("split-n", "string,string,int", splitNFunction).returns("list"),
+	"parse-int":        NewFunction("parse-int", "string", parseIntFunction).returns("int"),
+	"parse-float":      NewFunction("parse-float", "string", parseFloatFunction).returns("float"),
+	"get":              NewFunction("get", "list,int", getFunction),
+	"hget":             NewFunction("hget", "hash,string|symbol", hgetFunction),
+	"hset!":            NewFunction("hset!", "hash,string|symbol,*", hsetBangFunction).returns("hash"),
+	"hcontains":        NewFunction("hcontains", "hash,string|symbol", hcontainsFunction).returns("bool"),
+	"type":             NewFunction("type", "*", typeFunction).returns("type"),
+	"int":              NewFunction("int", "int|float|char", intFunction).returns("int"),
+	"float":            NewFunction("float", "int|float", floatFunction).returns("float"),
+	"string":           NewFunction("string", "*", stringFunction).returns("string"),
+	"bool":             NewFunction("bool", "*", boolFunction).returns("bool"),
+	"unwrap":           NewFunction("unwrap", "*", unwrapFunction),
+	"doc":              NewFunction("doc", "*", docFunction).returns("string|nil"),
+	"source":           NewFunction("source", "*", sourceFunction),
+	"arglist":          NewFunction("arglist", "*", arglistFunction).returns("list"),
+	"apropos":          NewFunction("apropos", "string", aproposFunction).returns("list"),
+	"break":            NewFunction("break", "**", breakFunction).returns("nil"),
+	"range":            NewFunction("range", "**", rangeFunction).returns("seq"),
+	"map":              NewFunction("map", "function|generic,list|hash|seq|chan,**", mapFunction).returns("list"),
+	"filter":           NewFunction("filter", "function|generic,list|hash|seq|chan", filterFunction).returns("list"),
+	"reduce":           NewFunction("reduce", "function|generic,list|hash|seq|chan,**", reduceFunction),
+	"sort":             NewFunction("sort", "*,**", sortFunction).returns("list"),
+	"sort-by":          NewFunction("sort-by", "function|generic,*,**", sortByFunction).returns("list"),
+	"group-by":         NewFunction("group-by", "function|generic,list|hash|seq|chan", groupByFunction).returns("hash"),
+	"partition":        NewFunction("partition", "int,list|hash|seq|chan", partitionFunction).returns("list"),
+	"zip":              NewFunction("zip", "list|hash|seq|chan,**", zipFunction).returns("list"),
+	"flatten":          NewFunction("flatten", "list|hash|seq|chan", flattenFunction).returns("list"),
+	"distinct":         NewFunction("distinct", "list|hash|seq|chan", distinctFunction).returns("list"),
+	"any?":             NewFunction("any?", "function|generic,list|hash|seq|chan", anyFunction).returns("bool"),
+	"every?":           NewFunction("every?", "function|generic,list|hash|seq|chan", everyFunction).returns("bool"),
+	"find":             NewFunction("find", "function|generic,list|hash|seq|chan", findFunction),
+	"iterate":          NewFunction("iterate", "function|generic,*", iterateFunction).returns("seq"),
+	"repeat":           NewFunction("repeat", "*,**", repeatFunction).returns("seq"),
+	"cycle":            NewFunction("cycle", "list|seq", cycleFunction).returns("seq"),
+	"take":             NewFunction("take", "int,list|seq|chan", takeFunction).returns("seq"),
+	"drop":             NewFunction("drop", "int,list|seq|chan", dropFunction).returns("seq"),
+	"take-while":       NewFunction("take-while", "function|generic,list|seq|chan", takeWhileFunction).returns("seq"),
+	"lazy-map":         NewFunction("lazy-map", "function|generic,list|seq|chan", lazyMapFunction).returns("seq"),
+	"lazy-filter":      NewFunction("lazy-filter", "function|generic,list|seq|chan", lazyFilterFunction).returns("seq"),
+	"collect":          NewFunction("collect", "list|seq|chan", collectFunction).returns("list"),
+	"read-lines":       NewFunction("read-lines", "string", readLinesFunction).returns("seq"),
+	"spawn":            NewFunction("spawn", "function|generic,**", spawnFunction).returns("future"),
+	"await":            NewFunction("await", "future", awaitFunction),
+	"chan":             NewFunction("chan", "**", chanFunction).returns("chan"),
+	"send!":            NewFunction("send!", "chan,*", sendBangFunction),
+	"recv":             NewFunction("recv", "chan", recvFunction),
+	"close!":           NewFunction("close!", "chan", closeBangFunction).returns("nil"),
+	"ref":              NewFunction("ref", "*", refFunction).returns("ref"),
+	"deref":            NewFunction("deref", "ref|future", derefFunction),
+	"reset!":           NewFunction("reset!", "ref,*", resetBangFunction),
+	"swap!":            NewFunction("swap!", "ref,function|generic,**", swapBangFunction),
+	"compare-and-set!": NewFunction("compare-and-set!", "ref,*,*", compareAndSetBangFunction).returns("bool"),
+	"add-watch!":       NewFunction("add-watch!", "ref,string|symbol,function|generic", addWatchBangFunction).returns("ref"),
+	"remove-watch!":    NewFunction("remove-watch!", "ref,string|symbol", removeWatchBangFunction).returns("ref"),
+	"time/now":         NewFunction("time/now", "**", nowFunction).returns("time"),
+	"time/sleep":       NewFunction("time/sleep", "int|float|duration", sleepFunction).returns("nil"),
+	"time/since":       NewFunction("time/since", "time", sinceFunction).returns("duration"),
+	"time/duration":    NewFunction("time/duration", "int|float|string|duration", durationFunction).returns("duration"),
+	"time/seconds":     NewFunction("time/seconds", "duration", secondsFunction).returns("float"),
+	"time/millis":      NewFunction("time/millis", "duration", millisFunction).returns("int"),
+	"time/add":         NewFunction("time/add", "time|duration,duration", timeAddFunction).returns("time|duration"),
+	"time/sub":         NewFunction("time/sub", "time|duration,time|duration", timeSubFunction).returns("time|duration"),
+	"time/before?":     NewFunction("time/before?", "time,time", beforeFunction).returns("bool"),
+	"time/after?":      NewFunction("time/after?", "time,time", afterFunction).returns("bool"),
+	"time/format":      NewFunction("time/format", "time,string", formatFunction).returns("string"),
+	"time/parse":       NewFunction("time/parse", "string,string", parseTimeFunction).returns("time"),
+	"time/in":          NewFunction("time/in", "time,string", inFunction).returns("time"),
+	"time/utc":         NewFunction("time/utc", "time", utcFunction).returns("time"),
+	"time/unix":        NewFunction("time/unix", "time", unixFunction).returns("int"),
+	"time/from-unix":   NewFunction("time/from-unix", "int|float", fromUnixFunction).returns("time"),
+	"time/timer":       NewFunction("time/timer", "int|float|duration", timerFunction).returns("chan"),
+	"time/ticker":      NewFunction("time/ticker", "int|float|duration", tickerFunction).returns("chan"),
+	"floor":            NewFunction("floor", "float", floorFunction).returns("float"),
+	"ceil":             NewFunction("ceil", "float", ceilFunction).returns("float"),
 }
 
 var aliases = map[string]string{
@@ -65,6 +131,7 @@ var aliases = map[string]string{
 	"!":     "not",
 	"<":     "lt",
 	">":     "gt",
+	"sleep": "time/sleep",
 }
 
 func setBuiltins(c Context) {
@@ -82,7 +149,21 @@ func execFunction(input *List, c Context) Value {
 	return x.Eval(c)
 }
 
+// evalFunction evaluates a form given as data, such as a quoted list or an
+// identifier, or each of the forms in a string.
 func evalFunction(input *List, c Context) Value {
+	switch x := input.children[0].(type) {
+	case *List:
+		form := x.Copy().(*List)
+		form.Quoted = false
+		return form.Eval(c)
+	case Atom:
+		if x.t != "string" {
+			return x.Eval(c)
+		}
+	default:
+		return x
+	}
 	var last Value = NIL
 	x := input.children[0].Value().(string)
 	nodes, err := Parse(Tokenize(x))
@@ -98,6 +179,39 @@ func evalFunction(input *List, c Context) Value {
 	return last
 }
 
+// nameOf returns the name of an identifier or symbol without the ':', or a
+// string as it is.
+func nameOf(v Value) string {
+	if v.Type() == "symbol" {
+		return v.Value().(string)[1:]
+	}
+	return v.Value().(string)
+}
+
+func symbolFunction(input *List, c Context) Value {
+	name := nameOf(input.children[0])
+	if !isIdentifier(name) || strings.HasSuffix(name, "...") {
+		return Atom{t: "error", value: fmt.Sprintf("Could not convert '%s' to an identifier.", name)}
+	}
+	return Atom{t: "identifier", value: name}
+}
+
+func keywordFunction(input *List, c Context) Value {
+	name := ":" + nameOf(input.children[0])
+	if !isSymbol(name) {
+		return Atom{t: "error", value: fmt.Sprintf("Could not convert '%s' to a symbol.", name[1:])}
+	}
+	return Atom{t: "symbol", value: name}
+}
+
+func nameFunction(input *List, c Context) Value {
+	return Atom{t: "string", value: nameOf(input.children[0])}
+}
+
+func isIdentifierFunction(input *List, c Context) Value {
+	return Atom{t: "bool", value: input.children[0].Type() == "identifier"}
+}
+
 // math
 func modFunction(input *List, c Context) Value {
 	return Atom{t: "int", value: input.children[0].Value().(int64) % input.children[1].Value().(int64)}
@@ -139,13 +253,9 @@ func ceilFunction(input *List, c Context) Value {
 func printFunction(input *List, c Context) Value {
 	output := []string{}
 	for _, n := range input.children {
-		if n.Type() == "string" {
-			output = append(output, n.Value().(string))
-		} else {
-			output = append(output, n.String())
-		}
+		output = append(output, display(n))
 	}
-	fmt.Printf(strings.Join(output, " "))
+	fmt.Print(strings.Join(output, " "))
 	return NIL
 }
 
@@ -155,11 +265,7 @@ func printlnFunction(input *List, c Context) Value {
 	} else {
 		output := []string{}
 		for _, n := range input.children {
-			if n.Type() == "string" {
-				output = append(output, n.Value().(string))
-			} else {
-				output = append(output, n.String())
-			}
+			output = append(output, display(n))
 		}
 		fmt.Println(strings.Join(output, " "))
 	}
@@ -187,8 +293,9 @@ func consFunction(input *List, c Context) Value {
 	} else {
 		right = input.children[1].(*List)
 	}
-	left.children = append(left.children, right.children...)
-	return left
+	children := make([]Value, 0, len(left.children)+len(right.children))
+	children = append(children, left.children...)
+	return &List{children: append(children, right.children...)}
 }
 
 func revFunction(input *List, c Context) Value {
@@ -207,6 +314,11 @@ func lenFunction(input *List, c Context) Value {
 		return input.children[0].(*List).Length()
 	} else if input.children[0].Type() == "hash" {
 		return input.children[0].(*Hash).Length()
+	} else if input.children[0].Type() == "seq" {
+		if isInfinite(input.children[0]) {
+			return infiniteError("len")
+		}
+		return input.children[0].(*Seq).Length()
 	} else {
 		return input.children[0].(Atom).Length()
 	}
@@ -353,37 +465,21 @@ func parseFloatFunction(input *List, c Context) Value {
 
 // hash
 func hgetFunction(input *List, c Context) Value {
-	h := input.children[0].(*Hash)
-	s := input.children[1].Value().(string)
-	if input.children[1].Type() == "string" {
-		return h.vals[s]
-	} else {
-		return h.sym_vals[s]
+	if v, ok := input.children[0].(*Hash).Get(input.children[1]); ok {
+		return v
 	}
+	return NIL
 }
 
 func hsetBangFunction(input *List, c Context) Value {
 	h := input.children[0].(*Hash)
-	s := input.children[1].Value().(string)
-	v := input.children[2]
-	if input.children[1].Type() == "string" {
-		h.vals[s] = v
-	} else {
-		h.sym_vals[s] = v
-	}
+	h.Set(input.children[1], input.children[2])
 	return h
 }
 
 func hcontainsFunction(input *List, c Context) Value {
-	h := input.children[0].(*Hash)
-	s := input.children[1].Value().(string)
-	if input.children[1].Type() == "string" {
-		_, ok := h.vals[s]
-		return Atom{t: "bool", value: ok}
-	} else {
-		_, ok := h.sym_vals[s]
-		return Atom{t: "bool", value: ok}
-	}
+	_, ok := input.children[0].(*Hash).Get(input.children[1])
+	return Atom{t: "bool", value: ok}
 }
 
 // type
@@ -392,8 +488,11 @@ func typeFunction(input *List, c Context) Value {
 }
 
 func intFunction(input *List, c Context) Value {
-	if input.children[0].Type() == "int" {
+	switch input.children[0].Type() {
+	case "int":
 		return input.children[0]
+	case "char":
+		return Atom{t: "int", value: int(input.children[0].Value().(rune))}
 	}
 	return Atom{t: "int", value: int(input.children[0].Value().(float64))}
 }
@@ -409,9 +508,109 @@ func stringFunction(input *List, c Context) Value {
 	if input.children[0].Type() == "string" {
 		return input.children[0]
 	}
-	return Atom{t: "string", value: input.children[0].String()}
+	return Atom{t: "string", value: display(input.children[0])}
 }
 
 func boolFunction(input *List, c Context) Value {
 	return Atom{t: "bool", value: Boolean(input.children[0])}
 }
+
+func unwrapFunction(input *List, c Context) Value {
+	if t, ok := input.children[0].(*Tagged); ok {
+		return t.value
+	}
+	return input.children[0]
+}
+
+// introspection
+func describe(signature string, source *List, doc string) Value {
+	lines := []string{signature}
+	if source != nil && source.pos.IsValid() {
+		lines = append(lines, "  "+source.pos.String())
+	}
+	if doc != "" {
+		lines = append(lines, "  "+doc)
+	}
+	return Atom{t: "string", value: strings.Join(lines, "\n")}
+}
+
+func docFunction(input *List, c Context) Value {
+	v := input.children[0]
+	name := ""
+	if v.Type() == "string" || v.Type() == "symbol" {
+		name = strings.TrimPrefix(v.Value().(string), ":")
+		v = c.Get(name)
+	}
+	switch x := v.(type) {
+	case Function:
+		return describe(x.Signature(), x.source, x.doc)
+	case Macro:
+		return describe(x.Signature(), x.source, x.doc)
+	case *Generic:
+		return describe(signature(x.name, x.args), nil, fmt.Sprintf("generic with %d methods", len(x.methods)))
+	}
+	if name == "" {
+		return NIL
+	}
+	return describe(name, nil, c.Doc(name))
+}
+
+func sourceFunction(input *List, c Context) Value {
+	var source *List
+	switch x := input.children[0].(type) {
+	case Function:
+		source = x.source
+	case Macro:
+		source = x.source
+	}
+	if source == nil {
+		return NIL
+	}
+	l := source.Copy().(*List)
+	l.Quoted = true
+	return l
+}
+
+func arglistFunction(input *List, c Context) Value {
+	var args *List
+	types := ""
+	switch x := input.children[0].(type) {
+	case Function:
+		args, types = x.args, x.types
+	case Macro:
+		args, types = x.args, x.types
+	case *Generic:
+		args = x.args
+	default:
+		return Atom{t: "error", value: fmt.Sprintf("Cannot get argument list of type '%s'", input.children[0].Type())}
+	}
+	if args != nil {
+		l := args.Copy().(*List)
+		l.Quoted = true
+		return l
+	}
+	out := &List{Quoted: true}
+	for _, t := range strings.Split(types, ",") {
+		switch t {
+		case "**":
+			out.children = append(out.children, Atom{t: "type", value: "*..."})
+		case "+":
+			last := out.children[len(out.children)-1].Value().(string)
+			out.children = append(out.children, Atom{t: "type", value: last + "..."})
+		default:
+			out.children = append(out.children, Atom{t: "type", value: t})
+		}
+	}
+	return out
+}
+
+func aproposFunction(input *List, c Context) Value {
+	s := input.children[0].Value().(string)
+	out := &List{}
+	for _, name := range c.Names() {
+		if strings.Contains(name, s) {
+			out.children = append(out.children, Atom{t: "string", value: name})
+		}
+	}
+	return out
+}
@@ -0,0 +1,98 @@
+package sigmo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDocstrings(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `
+(def sq "Squares x." (lambda (x) (* x x)))
+(def answer "The answer." 42)
+(macro twice (x) "Doubles a form." (do x x))
+(def half (lambda (x) "Halves x." (/ x 2)))
+(defgeneric area (s))`)
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(doc sq)`, "(sq x)\n  <test>:2:22\n  Squares x."},
+		{`(doc :answer)`, "answer\n  The answer."},
+		{`(doc "answer")`, "answer\n  The answer."},
+		{`(doc +)`, "(+ int|float int|float...)"},
+		{`(doc area)`, "(area s)\n  generic with 0 methods"},
+		{`(doc twice)`, "(twice x)\n  <test>:4:1\n  Doubles a form."},
+		{`(doc half)`, "(half x)\n  <test>:5:11\n  Halves x."},
+		{`(half 4)`, "2"},
+		{`(doc 3)`, "nil"},
+		{`(source sq)`, "'(lambda (x) (* x x))"},
+		{`(source +)`, "nil"},
+		{`(arglist sq)`, "'(x)"},
+		{`(arglist +)`, "'(#int|float #int|float...)"},
+		{`(apropos "answ")`, `("answer")`},
+	} {
+		if got := display(evalString(t, c, tc.src)); got != tc.want {
+			t.Errorf("%s = %s, want %s", tc.src, got, tc.want)
+		}
+	}
+	if got := evalError(t, c, `(arglist 1)`); !strings.Contains(got, "Cannot get argument list of type 'int'") {
+		t.Errorf("(arglist 1): got error %q", got)
+	}
+}
+
+func TestCodeAsData(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `(def x 5)`)
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`'x`, "x"},
+		{`(type 'x)`, "#identifier"},
+		{`(quote (a b))`, "'(a b)"},
+		{`(quote :k)`, ":k"},
+		{`(symbol "foo")`, "foo"},
+		{`(symbol :bar)`, "bar"},
+		{`(keyword "a")`, ":a"},
+		{`(keyword 'b)`, ":b"},
+		{`(name :a)`, `"a"`},
+		{`(name 'c)`, `"c"`},
+		{`(name "s")`, `"s"`},
+		{`(identifier? 'x)`, "true"},
+		{`(identifier? :x)`, "false"},
+		{`(identifier? "x")`, "false"},
+		{`(eval 'x)`, "5"},
+		{`(eval (symbol "x"))`, "5"},
+		{`(eval '(+ 1 x))`, "6"},
+		{`(eval "(+ x 1)")`, "6"},
+		{`(eval (cons (symbol "+") '(1 2)))`, "3"},
+		{`(eval (cons '+ (cons 'x '(1))))`, "6"},
+		{`(eval :k)`, ":k"},
+		{`(eval 3)`, "3"},
+	} {
+		if got := evalString(t, c, tc.src).String(); got != tc.want {
+			t.Errorf("%s = %s, want %s", tc.src, got, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(symbol "a b")`, "Could not convert 'a b' to an identifier."},
+		{`(symbol "x...")`, "Could not convert 'x...' to an identifier."},
+		{`(keyword "a b")`, "Could not convert 'a b' to a symbol."},
+		{`(quote)`, "Wrong number of arguments to 'quote'"},
+		{`(eval 'y)`, "Unknown identifier 'y'"},
+	} {
+		if got := evalError(t, c, tc.src); !strings.Contains(got, tc.want) {
+			t.Errorf("%s: got error %q, want %q", tc.src, got, tc.want)
+		}
+	}
+	if errs := checkString(t, `(quote a b)`); len(errs) == 0 || !strings.Contains(errs[0].Error(), "Wrong number of arguments to 'quote'") {
+		t.Errorf("checking (quote a b): got %v", errs)
+	}
+	if errs := checkString(t, `(cat (quote x) "a")`); len(errs) == 0 || !strings.Contains(errs[0].Error(), "got 'identifier'") {
+		t.Errorf("checking (cat (quote x) \"a\"): got %v", errs)
+	}
+}
@@ -0,0 +1,593 @@
+package sigmo
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// imageMagic starts every image, so that other files, and images written by
+// an incompatible version, are refused.
+const imageMagic = "sigmo image 1\n"
+
+// imageValue is a value, closure environment or context in an image. They
+// refer to each other by their index in the image, where 0 is no value.
+type imageValue struct {
+	Kind     string
+	Type     string
+	Name     string
+	Doc      string
+	Str      string
+	Int      int64
+	Float    float64
+	Bool     bool
+	Pos      Pos
+	Ref      int
+	Env      int
+	Fallback int
+	Items    []int
+	Fields   map[string]int
+	Syms     map[string]int
+	Spaces   map[string]int
+	Docs     map[string]string
+}
+
+type image struct {
+	Root   int
+	Values []imageValue
+}
+
+type atomKey struct {
+	t string
+	v interface{}
+}
+
+type builtinKey string
+
+type funcKey struct {
+	source *List
+	env    uintptr
+	name   string
+	doc    string
+}
+
+type macroKey struct {
+	source *List
+	name   string
+	doc    string
+}
+
+type envKey uintptr
+
+// imageKey identifies v, so that a value held in several places is saved
+// once and restored as the same value in each of them.
+func imageKey(v Value) interface{} {
+	switch x := v.(type) {
+	case Atom:
+		return atomKey{x.t, atomValue(x)}
+	case *Atom:
+		return atomKey{x.t, atomValue(*x)}
+	case Function:
+		if x.source == nil {
+			return builtinKey(x.name)
+		}
+		return funcKey{x.source, reflect.ValueOf(x.env).Pointer(), x.name, x.doc}
+	case Macro:
+		return macroKey{x.source, x.name, x.doc}
+	}
+	return v
+}
+
+func atomValue(a Atom) interface{} {
+	switch a.value.(type) {
+	case nil, int, int64, int32, float64, bool, string:
+		return a.value
+	}
+	return fmt.Sprint(a.value)
+}
+
+type imageWriter struct {
+	values []imageValue
+	seen   map[interface{}]int
+}
+
+// reserve returns the index of the value with the given key, and false if
+// it is new and has yet to be filled in.
+func (w *imageWriter) reserve(key interface{}) (int, bool) {
+	if i, ok := w.seen[key]; ok {
+		return i, true
+	}
+	w.values = append(w.values, imageValue{})
+	w.seen[key] = len(w.values) - 1
+	return len(w.values) - 1, false
+}
+
+func (w *imageWriter) value(v Value) (int, error) {
+	i, ok := w.reserve(imageKey(v))
+	if ok {
+		return i, nil
+	}
+	x, err := w.encode(v)
+	w.values[i] = x
+	return i, err
+}
+
+func (w *imageWriter) list(vs []Value) ([]int, error) {
+	ids := []int{}
+	for _, v := range vs {
+		i, err := w.value(v)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, i)
+	}
+	return ids, nil
+}
+
+func (w *imageWriter) fields(m map[string]Value) (map[string]int, error) {
+	ids := make(map[string]int)
+	for k, v := range m {
+		i, err := w.value(v)
+		if err != nil {
+			return nil, err
+		}
+		ids[k] = i
+	}
+	return ids, nil
+}
+
+func (w *imageWriter) encode(v Value) (imageValue, error) {
+	switch x := v.(type) {
+	case Atom:
+		return encodeAtom(x), nil
+	case *Atom:
+		return encodeAtom(*x), nil
+	case *List:
+		items, err := w.list(x.children)
+		return imageValue{Kind: "list", Bool: x.Quoted, Pos: x.pos, Items: items}, err
+	case *Hash:
+		x.mu.RLock()
+		pairs := append([]Value{}, x.pairs...)
+		vals, syms := make(map[string]Value), make(map[string]Value)
+		for k, v := range x.vals {
+			vals[k] = v
+		}
+		for k, v := range x.sym_vals {
+			syms[k] = v
+		}
+		x.mu.RUnlock()
+		h := imageValue{Kind: "hash"}
+		var err error
+		if h.Items, err = w.list(pairs); err != nil {
+			return h, err
+		}
+		if h.Fields, err = w.fields(vals); err != nil {
+			return h, err
+		}
+		h.Syms, err = w.fields(syms)
+		return h, err
+	case Function:
+		if x.source == nil {
+			if _, ok := builtins[x.name]; !ok {
+				return imageValue{}, fmt.Errorf("Cannot save function '%s' in an image", x.name)
+			}
+			return imageValue{Kind: "builtin", Name: x.name}, nil
+		}
+		f := imageValue{Kind: "function", Name: x.name, Doc: x.doc}
+		var err error
+		if f.Ref, err = w.value(x.source); err != nil {
+			return f, err
+		}
+		if x.env != nil {
+			f.Env, err = w.env(x.env)
+		}
+		return f, err
+	case Macro:
+		if x.source == nil {
+			return imageValue{}, fmt.Errorf("Cannot save macro '%s' in an image", x.name)
+		}
+		m := imageValue{Kind: "macro", Name: x.name, Doc: x.doc}
+		var err error
+		m.Ref, err = w.value(x.source)
+		return m, err
+	case *Generic:
+		x.mu.RLock()
+		methods, fallback := x.methods, x.fallback
+		x.mu.RUnlock()
+		g := imageValue{Kind: "generic", Name: x.name}
+		var err error
+		if x.args != nil {
+			if g.Ref, err = w.value(x.args); err != nil {
+				return g, err
+			}
+		}
+		for _, m := range methods {
+			i, err := w.value(m.fn)
+			if err != nil {
+				return g, err
+			}
+			g.Items = append(g.Items, i)
+		}
+		if fallback != nil {
+			g.Fallback, err = w.value(fallback)
+		}
+		return g, err
+	case *Tagged:
+		i, err := w.value(x.value)
+		return imageValue{Kind: "tagged", Type: x.t, Ref: i}, err
+	case *Ref:
+		x.mu.Lock()
+		value := x.value
+		watches := make(map[string]Value)
+		for k, v := range x.watches {
+			watches[k] = v
+		}
+		x.mu.Unlock()
+		r := imageValue{Kind: "ref"}
+		var err error
+		if r.Ref, err = w.value(value); err != nil {
+			return r, err
+		}
+		r.Fields, err = w.fields(watches)
+		return r, err
+	case *Time:
+		text, err := x.t.MarshalText()
+		return imageValue{Kind: "time", Str: string(text)}, err
+	case *Duration:
+		return imageValue{Kind: "duration", Int: int64(x.d)}, nil
+	}
+	return imageValue{}, fmt.Errorf("Cannot save value of type '%s' in an image", v.Type())
+}
+
+func encodeAtom(a Atom) imageValue {
+	v := imageValue{Kind: "atom", Type: a.t}
+	switch x := atomValue(a).(type) {
+	case int:
+		v.Int = int64(x)
+	case int64:
+		v.Int = x
+	case rune:
+		v.Int = int64(x)
+	case float64:
+		v.Float = x
+	case bool:
+		v.Bool = x
+	case string:
+		v.Str = x
+	}
+	return v
+}
+
+// env saves the bindings a lambda closes over.
+func (w *imageWriter) env(m map[string]Value) (int, error) {
+	i, ok := w.reserve(envKey(reflect.ValueOf(m).Pointer()))
+	if ok {
+		return i, nil
+	}
+	fields, err := w.fields(m)
+	w.values[i] = imageValue{Kind: "env", Fields: fields}
+	return i, err
+}
+
+func (w *imageWriter) context(c Context) (int, error) {
+	x, ok := c.(*context)
+	if !ok {
+		return 0, fmt.Errorf("Cannot save context of type %T in an image", c)
+	}
+	i, ok := w.reserve(x)
+	if ok {
+		return i, nil
+	}
+	x.mu.RLock()
+	parent := x.parent
+	scope := make(map[string]Value)
+	for k, v := range x.scope {
+		scope[k] = v
+	}
+	docs := make(map[string]string)
+	for k, d := range x.docs {
+		docs[k] = d
+	}
+	namespaces := make(map[string]Context)
+	for k, ns := range x.namespaces {
+		namespaces[k] = ns
+	}
+	x.mu.RUnlock()
+
+	v := imageValue{Kind: "context", Name: x.ns, Docs: docs, Fields: make(map[string]int), Spaces: make(map[string]int)}
+	var err error
+	if parent != nil {
+		if v.Ref, err = w.context(parent); err != nil {
+			return i, err
+		}
+	}
+	names := []string{}
+	for name := range scope {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if v.Fields[name], err = w.value(scope[name]); err != nil {
+			return i, fmt.Errorf("error saving '%s': %v", name, err)
+		}
+	}
+	for name, ns := range namespaces {
+		if v.Spaces[name], err = w.context(ns); err != nil {
+			return i, err
+		}
+	}
+	w.values[i] = v
+	return i, nil
+}
+
+// SaveImage writes c to w as an image, along with its namespaces and every
+// value they hold, for LoadImage to restore without evaluating any code.
+// Lambdas and macros are saved as their source forms and the bindings they
+// close over, and builtins by name. Seqs, channels and futures can't be
+// saved.
+func SaveImage(w io.Writer, c Context) error {
+	iw := &imageWriter{values: []imageValue{{}}, seen: make(map[interface{}]int)}
+	root, err := iw.context(c)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, imageMagic); err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(image{Root: root, Values: iw.values})
+}
+
+type imageReader struct {
+	values   []imageValue
+	decoded  map[int]Value
+	envs     map[int]map[string]Value
+	contexts map[int]*context
+}
+
+// get returns the value at index i, checking it is of the given kind.
+func (r *imageReader) get(i int, kind string) (imageValue, error) {
+	if i <= 0 || i >= len(r.values) || (kind != "" && r.values[i].Kind != kind) {
+		return imageValue{}, fmt.Errorf("Corrupt image: bad reference %d", i)
+	}
+	return r.values[i], nil
+}
+
+func (r *imageReader) list(ids []int) ([]Value, error) {
+	vs := []Value{}
+	for _, i := range ids {
+		v, err := r.value(i)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+func (r *imageReader) fields(ids map[string]int, m map[string]Value) error {
+	for k, i := range ids {
+		v, err := r.value(i)
+		if err != nil {
+			return err
+		}
+		m[k] = v
+	}
+	return nil
+}
+
+func (r *imageReader) form(i int) (*List, error) {
+	v, err := r.value(i)
+	if err != nil {
+		return nil, err
+	}
+	l, ok := v.(*List)
+	if !ok {
+		return nil, fmt.Errorf("Corrupt image: expected a list, got type '%s'", v.Type())
+	}
+	return l, nil
+}
+
+func (r *imageReader) value(i int) (Value, error) {
+	if v, ok := r.decoded[i]; ok {
+		return v, nil
+	}
+	x, err := r.get(i, "")
+	if err != nil {
+		return nil, err
+	}
+	switch x.Kind {
+	case "atom":
+		a := Atom{t: x.Type, value: x.Str}
+		switch x.Type {
+		case "int":
+			a.value = int(x.Int)
+		case "char":
+			a.value = rune(x.Int)
+		case "float":
+			a.value = x.Float
+		case "bool":
+			a.value = x.Bool
+		case "nil":
+			a.value = nil
+		}
+		r.decoded[i] = a
+		return a, nil
+	case "list":
+		l := &List{Quoted: x.Bool, pos: x.Pos}
+		r.decoded[i] = l
+		children, err := r.list(x.Items)
+		l.children = children
+		return l, err
+	case "hash":
+		h := &Hash{vals: make(map[string]Value), sym_vals: make(map[string]Value)}
+		r.decoded[i] = h
+		pairs, err := r.list(x.Items)
+		if err != nil {
+			return nil, err
+		}
+		if len(pairs) > 0 {
+			h.pairs = pairs
+		}
+		if err := r.fields(x.Fields, h.vals); err != nil {
+			return nil, err
+		}
+		return h, r.fields(x.Syms, h.sym_vals)
+	case "builtin":
+		f, ok := builtins[x.Name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown builtin '%s' in image", x.Name)
+		}
+		r.decoded[i] = f
+		return f, nil
+	case "function":
+		source, err := r.form(x.Ref)
+		if err != nil {
+			return nil, err
+		}
+		var f Function
+		if isForm(source, "deftype") {
+			f = typeConstructor(x.Name, source)
+		} else {
+			var env map[string]Value
+			if x.Env != 0 {
+				if env, err = r.env(x.Env); err != nil {
+					return nil, err
+				}
+			}
+			f = closure(x.Name, source, env)
+		}
+		f.doc = x.Doc
+		r.decoded[i] = f
+		return f, nil
+	case "macro":
+		source, err := r.form(x.Ref)
+		if err != nil {
+			return nil, err
+		}
+		m := newMacro(x.Name, source)
+		m.doc = x.Doc
+		r.decoded[i] = m
+		return m, nil
+	case "generic":
+		g := NewGeneric(x.Name)
+		r.decoded[i] = g
+		if x.Ref != 0 {
+			args, err := r.form(x.Ref)
+			if err != nil {
+				return nil, err
+			}
+			g.args = args
+		}
+		for _, m := range x.Items {
+			v, err := r.value(m)
+			if err != nil {
+				return nil, err
+			}
+			fn, ok := v.(Function)
+			if !ok || fn.source == nil || len(fn.source.children) < 2 || fn.source.children[1].Type() != "list" {
+				return nil, fmt.Errorf("Corrupt image: bad method for '%s'", x.Name)
+			}
+			if v := g.AddMethod(fn.source.children[1].(*List), fn); v.Type() == "error" {
+				return nil, fmt.Errorf("%v", v.Value())
+			}
+		}
+		if x.Fallback != 0 {
+			fallback, err := r.value(x.Fallback)
+			if err != nil {
+				return nil, err
+			}
+			g.fallback = fallback
+		}
+		return g, nil
+	case "tagged":
+		t := &Tagged{t: x.Type}
+		r.decoded[i] = t
+		v, err := r.value(x.Ref)
+		t.value = v
+		return t, err
+	case "ref":
+		ref := NewRef(NIL)
+		r.decoded[i] = ref
+		v, err := r.value(x.Ref)
+		if err != nil {
+			return nil, err
+		}
+		ref.value = v
+		return ref, r.fields(x.Fields, ref.watches)
+	case "time":
+		t := &Time{}
+		if err := t.t.UnmarshalText([]byte(x.Str)); err != nil {
+			return nil, err
+		}
+		r.decoded[i] = t
+		return t, nil
+	case "duration":
+		d := &Duration{d: time.Duration(x.Int)}
+		r.decoded[i] = d
+		return d, nil
+	}
+	return nil, fmt.Errorf("Corrupt image: unknown kind '%s'", x.Kind)
+}
+
+func (r *imageReader) env(i int) (map[string]Value, error) {
+	if m, ok := r.envs[i]; ok {
+		return m, nil
+	}
+	x, err := r.get(i, "env")
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]Value)
+	r.envs[i] = m
+	return m, r.fields(x.Fields, m)
+}
+
+func (r *imageReader) context(i int) (*context, error) {
+	if c, ok := r.contexts[i]; ok {
+		return c, nil
+	}
+	x, err := r.get(i, "context")
+	if err != nil {
+		return nil, err
+	}
+	c := &context{ns: x.Name, scope: make(map[string]Value), docs: make(map[string]string), namespaces: make(map[string]Context)}
+	r.contexts[i] = c
+	if x.Ref != 0 {
+		if c.parent, err = r.context(x.Ref); err != nil {
+			return nil, err
+		}
+	}
+	for k, d := range x.Docs {
+		c.docs[k] = d
+	}
+	if err := r.fields(x.Fields, c.scope); err != nil {
+		return nil, err
+	}
+	for k, ns := range x.Spaces {
+		if c.namespaces[k], err = r.context(ns); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// LoadImage restores the context saved in an image by SaveImage.
+func LoadImage(in io.Reader) (Context, error) {
+	magic := make([]byte, len(imageMagic))
+	if _, err := io.ReadFull(in, magic); err != nil || string(magic) != imageMagic {
+		return nil, fmt.Errorf("Not a sigmo image")
+	}
+	var img image
+	if err := gob.NewDecoder(in).Decode(&img); err != nil {
+		return nil, fmt.Errorf("Corrupt image: %v", err)
+	}
+	r := &imageReader{values: img.Values, decoded: make(map[int]Value), envs: make(map[int]map[string]Value), contexts: make(map[int]*context)}
+	c, err := r.context(img.Root)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
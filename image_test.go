@@ -0,0 +1,95 @@
+package sigmo
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// roundTrip saves c to an image and loads it back.
+func roundTrip(t *testing.T, c Context) Context {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := SaveImage(&buf, c); err != nil {
+		t.Fatalf("saving image: %v", err)
+	}
+	loaded, err := LoadImage(&buf)
+	if err != nil {
+		t.Fatalf("loading image: %v", err)
+	}
+	return loaded
+}
+
+func TestImageRoundTrip(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `
+(def n 42)
+(def pi "Roughly." 3.14)
+(def words '("a" "b" :c #\d))
+(def h {"k" 1 :s 2})
+(def adder (lambda (x) (lambda (y) (+ x y))))
+(def add2 (adder 2))
+(def counter (ref 0))
+(def alias counter)
+(add-watch! counter "log" (lambda (k r old new) new))
+(deftype circle)
+(def c1 (circle 3))
+(defgeneric area (s) 0)
+(defmethod area (s#circle) (* 3 (unwrap s)))
+(macro twice (x) "Doubles a form." (do x x))
+(def when (time/parse "RFC3339" "2024-03-01T12:00:00Z"))
+(def wait (time/duration "1m"))
+(namespace geo (def origin 0))`)
+	loaded := roundTrip(t, c)
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`n`, "42"},
+		{`(doc :pi)`, `"pi\n  Roughly."`},
+		{`words`, `'("a" "b" :c #\d)`},
+		{`(hget h "k")`, "1"},
+		{`(hget h :s)`, "2"},
+		{`(add2 5)`, "7"},
+		{`((adder 10) 1)`, "11"},
+		{`(swap! counter + 1)`, "1"},
+		{`(area c1)`, "9"},
+		{`(area 1)`, "0"},
+		{`(type c1)`, "#circle"},
+		{`(twice (swap! counter + 1))`, "3"},
+		{`(time/format when "DateOnly")`, `"2024-03-01"`},
+		{`(time/millis wait)`, "60000"},
+		{`geo/origin`, "0"},
+		{`(len (map + '(1 2) '(3 4)))`, "2"},
+	} {
+		if got := evalString(t, loaded, tc.src).String(); got != tc.want {
+			t.Errorf("%s = %s, want %s", tc.src, got, tc.want)
+		}
+	}
+	// values held in several places are restored as one value
+	if loaded.Get("alias") != loaded.Get("counter") {
+		t.Errorf("ref held by two names was restored as copies")
+	}
+	if loaded.Get("counter") == c.Get("counter") {
+		t.Errorf("loaded image shares a ref with the saved context")
+	}
+	if got := roundTrip(t, loaded).Get("n").String(); got != "42" {
+		t.Errorf("resaved image has n = %s, want 42", got)
+	}
+}
+
+func TestImageErrors(t *testing.T) {
+	for _, src := range []string{`(def s (range))`, `(def ch (chan))`} {
+		c := NewContext(nil)
+		evalString(t, c, src)
+		err := SaveImage(&bytes.Buffer{}, c)
+		if err == nil || !strings.Contains(err.Error(), "Cannot save value of type") {
+			t.Errorf("saving %s: got %v, want an error", src, err)
+		}
+	}
+	for _, data := range []string{"", "(def x 1)", imageMagic + "garbage"} {
+		if _, err := LoadImage(strings.NewReader(data)); err == nil {
+			t.Errorf("loading %q: no error", data)
+		}
+	}
+}
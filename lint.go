@@ -0,0 +1,410 @@
+package sigmo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// LintRules describes the checks Lint can run.
+var LintRules = map[string]string{
+	"undefined-set":  "set! of an identifier that is never defined",
+	"arity":          "wrong number of arguments to a builtin",
+	"unused-let":     "let binding that is never used",
+	"shadow-builtin": "definition hiding a builtin or special form",
+	"cond-clause":    "cond clause that is not a two element list",
+}
+
+type LintIssue struct {
+	Pos  Pos
+	Rule string
+	Msg  string
+}
+
+func (i LintIssue) String() string {
+	return fmt.Sprintf("%s %s %s", i.Pos, i.Rule, i.Msg)
+}
+
+type linter struct {
+	rules map[string]bool
+	// defined holds the names defined at the top level of the file or the
+	// files it imports, and scopes those bound by the forms enclosing the
+	// one being walked, innermost last
+	defined map[string]bool
+	scopes  []map[string]bool
+	issues  []LintIssue
+	// ignored maps line numbers to the rules suppressed on them, with ""
+	// standing for every rule
+	ignored map[int][]string
+	file    []string
+}
+
+// Lint reports likely mistakes in src, running the given rules, or all of
+// them if rules is nil. A comment of '; lint:ignore [rule...]' suppresses
+// issues on its own line and the next one, and '; lint:file-ignore
+// [rule...]' suppresses them for the whole file.
+func Lint(file string, src string, rules map[string]bool) ([]LintIssue, error) {
+	nodes, err := ParseCST(file, src)
+	if err != nil {
+		return nil, err
+	}
+	if rules == nil {
+		rules = make(map[string]bool)
+		for r := range LintRules {
+			rules[r] = true
+		}
+	}
+	l := &linter{rules: rules, defined: make(map[string]bool), ignored: make(map[int][]string)}
+	l.collect(nodes, map[string]bool{file: true})
+	l.suppressions(nodes)
+	for _, n := range nodes {
+		l.walk(n)
+	}
+	out := []LintIssue{}
+	for _, i := range l.issues {
+		if !l.suppressed(i) {
+			out = append(out, i)
+		}
+	}
+	sort.SliceStable(out, func(a, b int) bool {
+		if out[a].Pos.Line != out[b].Pos.Line {
+			return out[a].Pos.Line < out[b].Pos.Line
+		}
+		return out[a].Pos.Col < out[b].Pos.Col
+	})
+	return out, nil
+}
+
+func (l *linter) report(rule string, n *Node, format string, args ...interface{}) {
+	if l.rules[rule] {
+		l.issues = append(l.issues, LintIssue{Pos: n.Pos, Rule: rule, Msg: fmt.Sprintf(format, args...)})
+	}
+}
+
+func (l *linter) suppressions(nodes []*Node) {
+	for _, n := range nodes {
+		if n.Kind == NodeList {
+			l.suppressions(n.Children)
+			continue
+		}
+		if n.Kind != NodeComment {
+			continue
+		}
+		fields := strings.Fields(strings.TrimLeft(n.Text, "; "))
+		if len(fields) == 0 {
+			continue
+		}
+		rules := fields[1:]
+		if len(rules) == 0 {
+			rules = []string{""}
+		}
+		switch fields[0] {
+		case "lint:ignore":
+			l.ignored[n.Pos.Line] = append(l.ignored[n.Pos.Line], rules...)
+			l.ignored[n.Pos.Line+1] = append(l.ignored[n.Pos.Line+1], rules...)
+		case "lint:file-ignore":
+			l.file = append(l.file, rules...)
+		}
+	}
+}
+
+func (l *linter) suppressed(i LintIssue) bool {
+	for _, r := range append(l.ignored[i.Pos.Line], l.file...) {
+		if r == "" || r == i.Rule {
+			return true
+		}
+	}
+	return false
+}
+
+// code returns the children of n other than comments.
+func code(n *Node) []*Node {
+	out := []*Node{}
+	for _, c := range n.Children {
+		if c.Kind != NodeComment {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func isCall(n *Node, name string) bool {
+	if n.Kind != NodeList || n.Text != "(" {
+		return false
+	}
+	c := code(n)
+	return len(c) > 0 && c[0].Kind == NodeAtom && c[0].Text == name
+}
+
+// bindingName returns the name bound by an argument or binding, such as
+// 'x', 'x#int', 'xs...', ':key' or '(x default)'.
+func bindingName(n *Node) string {
+	if n.Kind == NodeList {
+		c := code(n)
+		if len(c) == 0 {
+			return ""
+		}
+		n = c[0]
+	}
+	if n.Kind != NodeAtom {
+		return ""
+	}
+	name := strings.TrimPrefix(n.Text, ":")
+	name = strings.TrimSuffix(name, "...")
+	if i := strings.Index(name, "#"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// bindings returns the nodes naming what form defines or binds.
+func bindings(n *Node) []*Node {
+	c := code(n)
+	if n.Kind != NodeList || len(c) < 2 || c[0].Kind != NodeAtom {
+		return nil
+	}
+	args := func(i int) []*Node {
+		if len(c) > i && c[i].Kind == NodeList {
+			return code(c[i])
+		}
+		return nil
+	}
+	switch c[0].Text {
+	case "def", "defgeneric", "deftype":
+		return c[1:2]
+	case "defn", "macro", "defreader":
+		return append(c[1:2], args(2)...)
+	case "defmethod":
+		return args(2)
+	case "lambda":
+		return args(1)
+	case "for":
+		if a := args(1); len(a) > 0 {
+			return a[:1]
+		}
+	case "let":
+		out := []*Node{}
+		for i, b := range args(1) {
+			if i%2 == 0 {
+				out = append(out, b)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// definesName reports whether n defines the name after its head in the
+// scope it is evaluated in.
+func definesName(n *Node) bool {
+	for _, name := range []string{"def", "defn", "macro", "defgeneric", "deftype", "defreader"} {
+		if isCall(n, name) && len(code(n)) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// scope returns the names bound by a form that evaluates its body in a scope
+// of its own, and whether it does.
+func scope(n *Node) (map[string]bool, bool) {
+	c := code(n)
+	if n.Kind != NodeList || n.Text != "(" || len(c) < 2 || c[0].Kind != NodeAtom {
+		return nil, false
+	}
+	names := make(map[string]bool)
+	switch c[0].Text {
+	case "lambda", "defmethod", "let", "for":
+		for _, b := range bindings(n) {
+			names[bindingName(b)] = true
+		}
+	case "defn", "macro", "defreader":
+		for _, b := range bindings(n)[1:] {
+			names[bindingName(b)] = true
+		}
+	case "recv":
+		if len(c) < 3 {
+			return nil, false
+		}
+		names[bindingName(c[2])] = true
+	default:
+		return nil, false
+	}
+	return names, true
+}
+
+// collect records the names defined at the top level of nodes, outside of
+// any function or let, and in the files they import.
+func (l *linter) collect(nodes []*Node, seen map[string]bool) {
+	for _, n := range nodes {
+		if n.Kind != NodeList {
+			continue
+		}
+		if definesName(n) {
+			l.defined[bindingName(code(n)[1])] = true
+		}
+		if c := code(n); isCall(n, "import") && len(c) > 1 && c[1].Kind == NodeAtom {
+			l.collectImport(c[1], seen)
+		}
+		if _, ok := scope(n); !ok {
+			l.collect(n.Children, seen)
+		}
+	}
+}
+
+// isDefined reports whether name is bound where the form being walked is.
+func (l *linter) isDefined(name string) bool {
+	for i := len(l.scopes) - 1; i >= 0; i-- {
+		if l.scopes[i][name] {
+			return true
+		}
+	}
+	return l.defined[name]
+}
+
+func (l *linter) collectImport(n *Node, seen map[string]bool) {
+	path := fmt.Sprintf("%s/%s.mo", os.Getenv("SIGMO_ROOT"), n.Text)
+	if strings.HasPrefix(n.Text, `"`) {
+		path = strings.Trim(n.Text, `"`)
+	}
+	if seen[path] {
+		return
+	}
+	seen[path] = true
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if nodes, err := ParseCST(path, string(data)); err == nil {
+		l.collect(nodes, seen)
+	}
+}
+
+func isBuiltin(name string) bool {
+	_, fn := builtins[name]
+	_, alias := aliases[name]
+	_, form := specialForms[name]
+	return fn || alias || form
+}
+
+func (l *linter) walk(n *Node) {
+	if n.Kind != NodeList {
+		return
+	}
+	c := code(n)
+	if len(c) > 0 && c[0].Kind == NodeAtom && n.Text == "(" {
+		name := c[0].Text
+		switch name {
+		case "set!":
+			if len(c) > 1 && c[1].Kind == NodeAtom && !l.isDefined(c[1].Text) && !isBuiltin(c[1].Text) {
+				l.report("undefined-set", c[1], "set! of '%s', which is never defined", c[1].Text)
+			}
+		case "cond":
+			for _, clause := range c[1:] {
+				if clause.Kind != NodeList || clause.Text != "(" || len(code(clause)) != 2 {
+					l.report("cond-clause", clause, "cond clause should be a list of (test body)")
+				}
+			}
+		case "let":
+			l.unusedLet(c)
+		}
+		if _, ok := specialForms[name]; !ok {
+			l.arity(name, c)
+		}
+		for _, b := range bindings(n) {
+			if bn := bindingName(b); isBuiltin(bn) {
+				l.report("shadow-builtin", b, "'%s' hides the builtin of the same name", bn)
+			}
+		}
+		if definesName(n) && len(l.scopes) > 0 {
+			l.scopes[len(l.scopes)-1][bindingName(c[1])] = true
+		}
+	}
+	if names, ok := scope(n); ok {
+		l.scopes = append(l.scopes, names)
+		defer func() { l.scopes = l.scopes[:len(l.scopes)-1] }()
+	}
+	for _, child := range n.Children {
+		l.walk(child)
+	}
+}
+
+// arity checks calls to builtins against their NewFunction signatures.
+func (l *linter) arity(name string, c []*Node) {
+	if a, ok := aliases[name]; ok {
+		name = a
+	}
+	fn, ok := builtins[name]
+	if !ok || l.isDefined(c[0].Text) || fn.types == "**" {
+		return
+	}
+	for _, a := range c[1:] {
+		if a.Kind == NodeAtom && strings.HasSuffix(a.Text, "...") {
+			return
+		}
+	}
+	min, max := 0, 0
+	for _, t := range strings.Split(fn.types, ",") {
+		if t == "**" {
+			max = -1
+			break
+		}
+		min++
+		if t == "+" {
+			max = -1
+		}
+	}
+	if max == 0 {
+		max = min
+	}
+	got := len(c) - 1
+	switch {
+	case got < min && min == max, got > max && max >= 0:
+		l.report("arity", c[0], "'%s' expected %d args, got %d", c[0].Text, min, got)
+	case got < min:
+		l.report("arity", c[0], "'%s' expected at least %d args, got %d", c[0].Text, min, got)
+	}
+}
+
+func (l *linter) unusedLet(c []*Node) {
+	if len(c) < 2 || c[1].Kind != NodeList {
+		return
+	}
+	binds := code(c[1])
+	for i := 0; i < len(binds); i += 2 {
+		name := bindingName(binds[i])
+		if name == "" || strings.HasPrefix(name, "_") {
+			continue
+		}
+		scope := c[2:]
+		if i+2 < len(binds) {
+			scope = append(append([]*Node{}, binds[i+2:]...), scope...)
+		}
+		used := false
+		for _, n := range scope {
+			if references(n, name) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			l.report("unused-let", binds[i], "'%s' is bound but never used", name)
+		}
+	}
+}
+
+func references(n *Node, name string) bool {
+	switch n.Kind {
+	case NodeAtom:
+		return n.Text == name || n.Text == name+"..."
+	case NodeList:
+		for _, c := range n.Children {
+			if references(c, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
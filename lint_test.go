@@ -0,0 +1,84 @@
+package sigmo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func lintString(t *testing.T, src string, rules map[string]bool) []string {
+	t.Helper()
+	issues, err := Lint("<test>", src, rules)
+	if err != nil {
+		t.Fatalf("linting %q: %v", src, err)
+	}
+	out := []string{}
+	for _, i := range issues {
+		out = append(out, i.String())
+	}
+	return out
+}
+
+func TestLintRules(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(def x 1) (set! x 2)`, ""},
+		{`(set! y 2)`, "<test>:1:7 undefined-set set! of 'y', which is never defined"},
+		{`(let (x 1) (set! x 2))`, ""},
+		{`(len "a" "b")`, "<test>:1:2 arity 'len' expected 1 args, got 2"},
+		{`(hget {})`, "<test>:1:2 arity 'hget' expected 2 args, got 1"},
+		{`(cat)`, "<test>:1:2 arity 'cat' expected at least 2 args, got 0"},
+		{`(cat "a" rest...)`, ""},
+		{`(def len (lambda (x) x)) (len 1 2)`, "<test>:1:6 shadow-builtin 'len' hides the builtin of the same name"},
+		{`(let (x 1 y 2) y)`, "<test>:1:7 unused-let 'x' is bound but never used"},
+		{`(let (x 1 y x) y)`, ""},
+		{`(let (_x 1) 2)`, ""},
+		{`(let (x 1) x...)`, ""},
+		{`(cond (true 1) (false))`, "<test>:1:16 cond-clause cond clause should be a list of (test body)"},
+		{`(lambda (map) map)`, "<test>:1:10 shadow-builtin 'map' hides the builtin of the same name"},
+	} {
+		got := strings.Join(lintString(t, tc.src, nil), "\n")
+		if got != tc.want {
+			t.Errorf("linting %s:\n got %q\nwant %q", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestLintSuppression(t *testing.T) {
+	for _, tc := range []struct {
+		src   string
+		rules map[string]bool
+		want  int
+	}{
+		{"(set! a 1) (len)", nil, 2},
+		{"(set! a 1) (len)", map[string]bool{"arity": true}, 1},
+		{"; lint:ignore\n(set! a 1) (len)", nil, 0},
+		{"(set! a 1) ; lint:ignore arity\n(len)", nil, 1},
+		{"; lint:ignore arity\n\n(len)", nil, 1},
+		{"; lint:file-ignore undefined-set\n(set! a 1)\n(set! b 1)\n(len)", nil, 1},
+	} {
+		if got := lintString(t, tc.src, tc.rules); len(got) != tc.want {
+			t.Errorf("linting %q: got %q, want %d issues", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestLintImports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sigmo-lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib.mo"), []byte("(def counter 0)"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := `(import "` + filepath.Join(dir, "lib.mo") + `") (set! counter 1) (set! other 1)`
+	got := lintString(t, src, nil)
+	if len(got) != 1 || !strings.Contains(got[0], "'other'") {
+		t.Errorf("got %q, want only 'other' reported", got)
+	}
+}
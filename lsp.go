@@ -0,0 +1,748 @@
+package sigmo
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// symbol and completion item kinds, as numbered by the protocol
+const (
+	lspNamespace = 3
+	lspClass     = 5
+	lspFunction  = 12
+	lspVariable  = 13
+
+	completionFunction = 3
+	completionVariable = 6
+	completionClass    = 7
+	completionModule   = 9
+	completionKeyword  = 14
+	completionFile     = 17
+	completionFolder   = 19
+)
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string              `json:"name"`
+	Detail         string              `json:"detail,omitempty"`
+	Kind           int                 `json:"kind"`
+	Range          lspRange            `json:"range"`
+	SelectionRange lspRange            `json:"selectionRange"`
+	Children       []lspDocumentSymbol `json:"children,omitempty"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspCompletionItem struct {
+	Label         string       `json:"label"`
+	Kind          int          `json:"kind,omitempty"`
+	Detail        string       `json:"detail,omitempty"`
+	Documentation string       `json:"documentation,omitempty"`
+	TextEdit      *lspTextEdit `json:"textEdit,omitempty"`
+}
+
+type lspMarkup struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type lspHover struct {
+	Contents lspMarkup `json:"contents"`
+	Range    lspRange  `json:"range"`
+}
+
+type lspRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type lspPositionParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspServer struct {
+	r    *bufio.Reader
+	w    io.Writer
+	root Context
+	// dir is the workspace root the client gives, which relative imports
+	// are found from
+	dir string
+	// docs holds the text of the open documents by path, which is used in
+	// place of what is on disk
+	docs     map[string]string
+	shutdown bool
+}
+
+// ServeLSP runs a Language Server Protocol server, reading messages from r
+// and writing to w until it is sent 'exit' or r is closed. It publishes
+// diagnostics from Parse and Check as documents change, and answers
+// definition, hover, completion and document symbol requests. Imports are
+// found as they are when running a file, but relative to the root the client
+// gives when initializing rather than the working directory.
+func ServeLSP(r io.Reader, w io.Writer) error {
+	s := &lspServer{r: bufio.NewReader(r), w: w, root: NewContext(nil), docs: make(map[string]string)}
+	for {
+		body, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		req := &lspRequest{}
+		if err := json.Unmarshal(body, req); err != nil {
+			s.send(map[string]interface{}{"id": nil, "error": &lspError{-32700, err.Error()}})
+			continue
+		}
+		if req.Method == "exit" {
+			if !s.shutdown {
+				return errors.New("exit before shutdown")
+			}
+			return nil
+		}
+		result, lerr := s.handle(req)
+		if len(req.ID) == 0 {
+			continue
+		}
+		msg := map[string]interface{}{"id": req.ID, "result": result}
+		if lerr != nil {
+			msg = map[string]interface{}{"id": req.ID, "error": lerr}
+		}
+		if err := s.send(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// read returns the content of the next message.
+func (s *lspServer) read() ([]byte, error) {
+	length := -1
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if v := strings.TrimPrefix(line, "Content-Length:"); v != line {
+			if length, err = strconv.Atoi(strings.TrimSpace(v)); err != nil {
+				return nil, fmt.Errorf("Invalid Content-Length '%s'", v)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("Message has no Content-Length")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(s.r, body)
+	return body, err
+}
+
+func (s *lspServer) send(msg map[string]interface{}) error {
+	msg["jsonrpc"] = "2.0"
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	return err
+}
+
+func (s *lspServer) handle(req *lspRequest) (interface{}, *lspError) {
+	decode := func(v interface{}) *lspError {
+		if err := json.Unmarshal(req.Params, v); err != nil {
+			return &lspError{-32602, err.Error()}
+		}
+		return nil
+	}
+	switch req.Method {
+	case "initialize":
+		var p struct {
+			RootURI string `json:"rootUri"`
+		}
+		if err := decode(&p); err != nil {
+			return nil, err
+		}
+		if dir := uriPath(p.RootURI); filepath.IsAbs(dir) {
+			s.dir = dir
+		}
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       1,
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+				"completionProvider":     map[string]interface{}{"triggerCharacters": []string{"/", `"`}},
+			},
+			"serverInfo": map[string]string{"name": "sigmo"},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := decode(&p); err != nil {
+			return nil, err
+		}
+		s.docs[uriPath(p.TextDocument.URI)] = p.TextDocument.Text
+		s.publish(p.TextDocument.URI)
+		return nil, nil
+	case "textDocument/didChange":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := decode(&p); err != nil {
+			return nil, err
+		}
+		// changes are always sent whole, as asked for in initialize
+		if n := len(p.ContentChanges); n > 0 {
+			s.docs[uriPath(p.TextDocument.URI)] = p.ContentChanges[n-1].Text
+		}
+		s.publish(p.TextDocument.URI)
+		return nil, nil
+	case "textDocument/didClose":
+		var p lspPositionParams
+		if err := decode(&p); err != nil {
+			return nil, err
+		}
+		delete(s.docs, uriPath(p.TextDocument.URI))
+		s.send(map[string]interface{}{
+			"method": "textDocument/publishDiagnostics",
+			"params": map[string]interface{}{"uri": p.TextDocument.URI, "diagnostics": []lspDiagnostic{}},
+		})
+		return nil, nil
+	case "textDocument/definition", "textDocument/hover", "textDocument/completion", "textDocument/documentSymbol":
+		var p lspPositionParams
+		if err := decode(&p); err != nil {
+			return nil, err
+		}
+		d := s.document(uriPath(p.TextDocument.URI))
+		if d == nil {
+			return nil, nil
+		}
+		switch req.Method {
+		case "textDocument/definition":
+			return s.definition(d, p.Position), nil
+		case "textDocument/hover":
+			return s.hover(d, p.Position), nil
+		case "textDocument/completion":
+			return s.completion(d, p.Position), nil
+		default:
+			return documentSymbols(d, lspSymbols(d.path, d.nodes, "")), nil
+		}
+	}
+	if len(req.ID) > 0 {
+		return nil, &lspError{-32601, fmt.Sprintf("Unknown method '%s'", req.Method)}
+	}
+	return nil, nil
+}
+
+// uriPath returns the file path of a file URI, or other URIs unchanged so
+// that they can still be told apart.
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+func pathURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// lspDocument is a source file as of a request, with its syntax tree, or nil
+// nodes if it doesn't parse.
+type lspDocument struct {
+	path  string
+	text  string
+	lines [][]rune
+	nodes []*Node
+}
+
+// document returns the open document at path, or else the file on disk, or
+// nil if there is neither.
+func (s *lspServer) document(path string) *lspDocument {
+	text, ok := s.docs[path]
+	if !ok {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		text = string(data)
+	}
+	d := &lspDocument{path: path, text: text}
+	for _, line := range strings.Split(text, "\n") {
+		d.lines = append(d.lines, []rune(line))
+	}
+	d.nodes, _ = ParseCST(path, text)
+	return d
+}
+
+// position converts p, which counts runes, to the UTF-16 code units the
+// protocol counts.
+func (d *lspDocument) position(p Pos) lspPosition {
+	line, char := p.Line-1, 0
+	if line >= 0 && line < len(d.lines) {
+		for i, r := range d.lines[line] {
+			if i >= p.Col-1 {
+				break
+			}
+			char += utf16Len(r)
+		}
+	}
+	return lspPosition{Line: line, Character: char}
+}
+
+func (d *lspDocument) pos(p lspPosition) Pos {
+	col, char := 1, 0
+	if p.Line >= 0 && p.Line < len(d.lines) {
+		for _, r := range d.lines[p.Line] {
+			if char >= p.Character {
+				break
+			}
+			char += utf16Len(r)
+			col++
+		}
+	}
+	return Pos{File: d.path, Line: p.Line + 1, Col: col}
+}
+
+func (d *lspDocument) span(n *Node) lspRange {
+	return lspRange{Start: d.position(n.Pos), End: d.position(n.End)}
+}
+
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+func before(a, b Pos) bool {
+	return a.Line < b.Line || (a.Line == b.Line && a.Col < b.Col)
+}
+
+// atomAt returns the atom p is in or just after.
+func atomAt(nodes []*Node, p Pos) *Node {
+	for _, n := range nodes {
+		if before(p, n.Pos) || before(n.End, p) {
+			continue
+		}
+		switch n.Kind {
+		case NodeAtom:
+			return n
+		case NodeList:
+			if a := atomAt(n.Children, p); a != nil {
+				return a
+			}
+		}
+	}
+	return nil
+}
+
+// listAt returns the list starting at p.
+func listAt(nodes []*Node, p Pos) *Node {
+	for _, n := range nodes {
+		if n.Kind != NodeList || before(p, n.Pos) || before(n.End, p) {
+			continue
+		}
+		if n.Pos == p {
+			return n
+		}
+		return listAt(n.Children, p)
+	}
+	return nil
+}
+
+// findAtom returns the first atom in n with the given text that isn't in
+// used.
+func findAtom(n *Node, text string, used map[*Node]bool) *Node {
+	if n.Kind == NodeAtom && n.Text == text && !used[n] {
+		return n
+	}
+	for _, c := range n.Children {
+		if a := findAtom(c, text, used); a != nil {
+			return a
+		}
+	}
+	return nil
+}
+
+func (s *lspServer) publish(uri string) error {
+	return s.send(map[string]interface{}{
+		"method": "textDocument/publishDiagnostics",
+		"params": map[string]interface{}{"uri": uri, "diagnostics": s.diagnostics(uriPath(uri))},
+	})
+}
+
+// diagnostics reports the error ParseFile stops at, or else the errors
+// Check finds in the file itself rather than in the files it imports.
+func (s *lspServer) diagnostics(path string) []lspDiagnostic {
+	out := []lspDiagnostic{}
+	d := s.document(path)
+	if d == nil {
+		return out
+	}
+	nodes, err := ParseFile(path, d.text)
+	if err != nil {
+		r := lspRange{}
+		var pe *ParseError
+		if errors.As(err, &pe) && pe.Pos.IsValid() {
+			r.Start = d.position(pe.Pos)
+			r.End = d.position(Pos{Line: pe.Pos.Line, Col: pe.Pos.Col + 1})
+			if a := atomAt(d.nodes, pe.Pos); a != nil && a.Pos == pe.Pos {
+				r = d.span(a)
+			}
+		}
+		return append(out, lspDiagnostic{Range: r, Severity: 1, Source: "sigmo", Message: err.Error()})
+	}
+	used := make(map[*Node]bool)
+	for _, err := range checkIn(s.dir, nodes) {
+		e, ok := err.(CheckError)
+		if !ok || (e.Pos.IsValid() && e.Pos.File != path) {
+			continue
+		}
+		r := lspRange{Start: d.position(e.Pos), End: d.position(e.Pos)}
+		if l := listAt(d.nodes, e.Pos); l != nil {
+			r = d.span(l)
+			if a := findAtom(l, e.Form, used); a != nil {
+				used[a] = true
+				r = d.span(a)
+			}
+		}
+		out = append(out, lspDiagnostic{Range: r, Severity: 1, Source: "sigmo", Message: e.Msg})
+	}
+	return out
+}
+
+// lspSymbol is a definition made by def, defn, macro, defgeneric, deftype
+// or namespace.
+type lspSymbol struct {
+	// name is qualified by the namespaces the definition is in
+	name     string
+	kind     int
+	detail   string
+	doc      string
+	path     string
+	form     *Node
+	nameNode *Node
+	children []*lspSymbol
+}
+
+// docString returns the text of n if it is a string.
+func docString(n *Node) (string, bool) {
+	if n.Kind != NodeAtom || !strings.HasPrefix(n.Text, `"`) {
+		return "", false
+	}
+	v, err := categorize(n.Text)
+	if err != nil || v.Type() != "string" {
+		return "", false
+	}
+	return v.Value().(string), true
+}
+
+func nodeString(n *Node) string {
+	if n.Kind != NodeList {
+		return n.Text
+	}
+	parts := []string{}
+	for _, c := range code(n) {
+		parts = append(parts, nodeString(c))
+	}
+	return n.Text + strings.Join(parts, " ") + n.Close()
+}
+
+func lspSymbols(path string, nodes []*Node, ns string) []*lspSymbol {
+	out := []*lspSymbol{}
+	for _, n := range nodes {
+		c := code(n)
+		if n.Kind != NodeList || n.Text != "(" || len(c) < 2 || c[0].Kind != NodeAtom || c[1].Kind != NodeAtom {
+			continue
+		}
+		sym := &lspSymbol{name: ns + c[1].Text, kind: lspFunction, path: path, form: n, nameNode: c[1]}
+		switch c[0].Text {
+		case "defn", "macro", "defgeneric":
+			if len(c) > 2 && c[2].Kind == NodeList {
+				parts := []string{c[1].Text}
+				for _, a := range code(c[2]) {
+					parts = append(parts, nodeString(a))
+				}
+				sym.detail = "(" + strings.Join(parts, " ") + ")"
+			}
+			if len(c) > 4 {
+				sym.doc, _ = docString(c[3])
+			}
+		case "def":
+			if !isCall(c[len(c)-1], "lambda") {
+				sym.kind = lspVariable
+			}
+			if len(c) == 4 {
+				sym.doc, _ = docString(c[2])
+			}
+		case "deftype":
+			sym.kind = lspClass
+		case "namespace":
+			sym.kind = lspNamespace
+			sym.children = lspSymbols(path, c[2:], sym.name+"/")
+		default:
+			continue
+		}
+		out = append(out, sym)
+	}
+	return out
+}
+
+func documentSymbols(d *lspDocument, syms []*lspSymbol) []lspDocumentSymbol {
+	out := []lspDocumentSymbol{}
+	for _, sym := range syms {
+		out = append(out, lspDocumentSymbol{
+			Name:           sym.nameNode.Text,
+			Detail:         sym.detail,
+			Kind:           sym.kind,
+			Range:          d.span(sym.form),
+			SelectionRange: d.span(sym.nameNode),
+			Children:       documentSymbols(d, sym.children),
+		})
+	}
+	return out
+}
+
+// imports returns the paths of the files imported in nodes, with relative
+// ones found from dir.
+func imports(nodes []*Node, dir string) []string {
+	out := []string{}
+	for _, n := range nodes {
+		if n.Kind != NodeList {
+			continue
+		}
+		if c := code(n); isCall(n, "import") && len(c) > 1 && c[1].Kind == NodeAtom {
+			if v, err := categorize(c[1].Text); err == nil {
+				if path, err := importPath(v); err == nil {
+					path = resolvePath(dir, path)
+					if abs, err := filepath.Abs(path); err == nil {
+						path = abs
+					}
+					out = append(out, path)
+				}
+			}
+		}
+		out = append(out, imports(n.Children, dir)...)
+	}
+	return out
+}
+
+// definitions returns every symbol defined in the document at path, then
+// those in the files it imports.
+func (s *lspServer) definitions(path string) []*lspSymbol {
+	out := []*lspSymbol{}
+	seen := make(map[string]bool)
+	var flatten func([]*lspSymbol)
+	flatten = func(syms []*lspSymbol) {
+		for _, sym := range syms {
+			out = append(out, sym)
+			flatten(sym.children)
+		}
+	}
+	var visit func(string)
+	visit = func(path string) {
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		d := s.document(path)
+		if d == nil {
+			return
+		}
+		flatten(lspSymbols(path, d.nodes, ""))
+		for _, i := range imports(d.nodes, s.dir) {
+			visit(i)
+		}
+	}
+	visit(path)
+	return out
+}
+
+// lookup finds the definition of name, which may be unqualified if it is
+// used inside its namespace.
+func (s *lspServer) lookup(name string, path string) *lspSymbol {
+	syms := s.definitions(path)
+	for _, sym := range syms {
+		if sym.name == name {
+			return sym
+		}
+	}
+	for _, sym := range syms {
+		if strings.HasSuffix(sym.name, "/"+name) {
+			return sym
+		}
+	}
+	return nil
+}
+
+// word returns the atom at p, and the identifier it names.
+func (d *lspDocument) word(p lspPosition) (*Node, string) {
+	a := atomAt(d.nodes, d.pos(p))
+	if a == nil {
+		return nil, ""
+	}
+	return a, strings.TrimSuffix(a.Text, "...")
+}
+
+func (s *lspServer) definition(d *lspDocument, p lspPosition) interface{} {
+	_, name := d.word(p)
+	sym := s.lookup(name, d.path)
+	if name == "" || sym == nil {
+		return nil
+	}
+	target := d
+	if sym.path != d.path {
+		if target = s.document(sym.path); target == nil {
+			return nil
+		}
+	}
+	return lspLocation{URI: pathURI(sym.path), Range: target.span(sym.nameNode)}
+}
+
+func (s *lspServer) hover(d *lspDocument, p lspPosition) interface{} {
+	a, name := d.word(p)
+	if a == nil {
+		return nil
+	}
+	signature, doc := "", ""
+	if sym := s.lookup(name, d.path); sym != nil {
+		signature, doc = sym.detail, sym.doc
+		if signature == "" {
+			signature = sym.name
+		}
+		if rel, err := filepath.Rel(filepath.Dir(d.path), sym.path); err == nil && sym.path != d.path {
+			doc = strings.TrimSpace(doc + "\n\n" + Pos{File: rel, Line: sym.nameNode.Pos.Line, Col: sym.nameNode.Pos.Col}.String())
+		}
+	} else if _, ok := specialForms[name]; ok {
+		signature, doc = "("+name+" ...)", "special form"
+	} else {
+		switch x := s.root.Get(name).(type) {
+		case Function:
+			signature, doc = x.Signature(), x.doc
+		case Macro:
+			signature, doc = x.Signature(), x.doc
+		default:
+			return nil
+		}
+	}
+	text := "```sigmo\n" + signature + "\n```"
+	if doc != "" {
+		text += "\n\n" + doc
+	}
+	return lspHover{Contents: lspMarkup{Kind: "markdown", Value: text}, Range: d.span(a)}
+}
+
+// completion offers what the REPL would complete the word before p to, along
+// with the definitions in the document and its imports.
+func (s *lspServer) completion(d *lspDocument, p lspPosition) interface{} {
+	at := d.pos(p)
+	head := ""
+	if at.Line >= 1 && at.Line <= len(d.lines) {
+		head = string(d.lines[at.Line-1][:at.Col-1])
+	}
+	word, names := completerIn(s.root, s.dir)(head)
+	isPath := openQuote(head) >= 0 || importRegexp.MatchString(strings.TrimSuffix(head, word))
+	start := d.position(Pos{Line: at.Line, Col: at.Col - len([]rune(word))})
+	edit := func(text string) *lspTextEdit {
+		return &lspTextEdit{Range: lspRange{Start: start, End: p}, NewText: text}
+	}
+
+	items := []lspCompletionItem{}
+	seen := make(map[string]bool)
+	if !isPath && word != "" {
+		kinds := map[int]int{lspFunction: completionFunction, lspVariable: completionVariable, lspClass: completionClass, lspNamespace: completionModule}
+		for _, sym := range s.definitions(d.path) {
+			if strings.HasPrefix(sym.name, word) && !seen[sym.name] {
+				seen[sym.name] = true
+				items = append(items, lspCompletionItem{Label: sym.name, Kind: kinds[sym.kind], Detail: sym.detail, Documentation: sym.doc, TextEdit: edit(sym.name)})
+			}
+		}
+	}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		item := lspCompletionItem{Label: name, Kind: completionFunction, TextEdit: edit(name)}
+		if _, ok := specialForms[name]; ok {
+			item.Kind = completionKeyword
+		}
+		switch x := s.root.Get(name).(type) {
+		case Function:
+			item.Detail, item.Documentation = x.Signature(), x.doc
+		case Macro:
+			item.Detail, item.Documentation = x.Signature(), x.doc
+		}
+		if isPath {
+			item.Kind, item.Detail, item.Documentation = completionFile, "", ""
+			if strings.HasSuffix(name, "/") {
+				item.Kind = completionFolder
+			}
+		}
+		items = append(items, item)
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+	return items
+}
@@ -0,0 +1,191 @@
+package sigmo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// lspClient talks to a server run by ServeLSP over a pair of pipes.
+type lspClient struct {
+	t    *testing.T
+	w    io.WriteCloser
+	r    *bufio.Reader
+	id   int
+	done chan error
+}
+
+func newLSPClient(t *testing.T) *lspClient {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	cl := &lspClient{t: t, w: inW, r: bufio.NewReader(outR), done: make(chan error, 1)}
+	go func() {
+		err := ServeLSP(inR, outW)
+		outW.Close()
+		cl.done <- err
+	}()
+	return cl
+}
+
+func (cl *lspClient) write(msg map[string]interface{}) {
+	cl.t.Helper()
+	msg["jsonrpc"] = "2.0"
+	data, err := json.Marshal(msg)
+	if err != nil {
+		cl.t.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(cl.w, "Content-Length: %d\r\n\r\n%s", len(data), data); err != nil {
+		cl.t.Fatal(err)
+	}
+}
+
+// next reads the next message the server sends.
+func (cl *lspClient) next() map[string]json.RawMessage {
+	cl.t.Helper()
+	length := -1
+	for {
+		line, err := cl.r.ReadString('\n')
+		if err != nil {
+			cl.t.Fatalf("reading header: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if v := strings.TrimPrefix(line, "Content-Length:"); v != line {
+			length, _ = strconv.Atoi(strings.TrimSpace(v))
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(cl.r, body); err != nil {
+		cl.t.Fatalf("reading body: %v", err)
+	}
+	msg := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		cl.t.Fatalf("%s: %v", body, err)
+	}
+	return msg
+}
+
+func (cl *lspClient) notify(method string, params interface{}) {
+	cl.t.Helper()
+	cl.write(map[string]interface{}{"method": method, "params": params})
+}
+
+// call sends a request and decodes the result of the response to it into
+// result.
+func (cl *lspClient) call(method string, params interface{}, result interface{}) {
+	cl.t.Helper()
+	cl.id++
+	cl.write(map[string]interface{}{"id": cl.id, "method": method, "params": params})
+	msg := cl.next()
+	if id := string(msg["id"]); id != strconv.Itoa(cl.id) {
+		cl.t.Fatalf("%s: got response to %s, want %d", method, id, cl.id)
+	}
+	if e, ok := msg["error"]; ok {
+		cl.t.Fatalf("%s: %s", method, e)
+	}
+	if result != nil {
+		if err := json.Unmarshal(msg["result"], result); err != nil {
+			cl.t.Fatalf("%s: %v", method, err)
+		}
+	}
+}
+
+func (cl *lspClient) diagnostics() []lspDiagnostic {
+	cl.t.Helper()
+	msg := cl.next()
+	if m := string(msg["method"]); m != `"textDocument/publishDiagnostics"` {
+		cl.t.Fatalf("got %s, want diagnostics", m)
+	}
+	var p struct {
+		Diagnostics []lspDiagnostic `json:"diagnostics"`
+	}
+	if err := json.Unmarshal(msg["params"], &p); err != nil {
+		cl.t.Fatal(err)
+	}
+	return p.Diagnostics
+}
+
+func positionParams(uri string, line, char int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     lspPosition{Line: line, Character: char},
+	}
+}
+
+func TestLSPSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sigmo-lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lib := "(def double \"Doubles x.\"\n  (lambda (x) (* x 2)))\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib.mo"), []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+
+	cl := newLSPClient(t)
+	cl.call("initialize", map[string]interface{}{"rootUri": pathURI(dir)}, nil)
+	if now, _ := os.Getwd(); now != wd {
+		t.Errorf("initialize changed the working directory to %s", now)
+	}
+
+	main := pathURI(filepath.Join(dir, "main.mo"))
+	cl.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]string{"uri": main, "text": "(import \"lib.mo\")\n(def n (double 4))\n"},
+	})
+	if d := cl.diagnostics(); len(d) != 0 {
+		t.Errorf("got diagnostics %v, want none", d)
+	}
+	cl.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]string{"uri": main},
+		"contentChanges": []map[string]string{{"text": "(import \"lib.mo\")\n(def n (double 4)\n"}},
+	})
+	if d := cl.diagnostics(); len(d) != 1 || d[0].Range.Start.Line != 1 {
+		t.Errorf("got diagnostics %v, want one on line 1", d)
+	}
+	cl.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]string{"uri": main},
+		"contentChanges": []map[string]string{{"text": "(import \"lib.mo\")\n(def n (double 4))\n"}},
+	})
+	cl.diagnostics()
+
+	var loc lspLocation
+	cl.call("textDocument/definition", positionParams(main, 1, 9), &loc)
+	if uriPath(loc.URI) != filepath.Join(dir, "lib.mo") || loc.Range.Start.Line != 0 {
+		t.Errorf("definition of double is %v, want lib.mo line 0", loc)
+	}
+
+	var hover lspHover
+	cl.call("textDocument/hover", positionParams(main, 1, 9), &hover)
+	if !strings.Contains(hover.Contents.Value, "Doubles x.") {
+		t.Errorf("hover is %q, want the docstring", hover.Contents.Value)
+	}
+
+	var symbols []lspDocumentSymbol
+	cl.call("textDocument/documentSymbol", positionParams(main, 0, 0), &symbols)
+	if len(symbols) != 1 || symbols[0].Name != "n" {
+		t.Errorf("symbols are %v, want n", symbols)
+	}
+
+	for _, p := range []map[string]interface{}{positionParams(main, -1, 0), positionParams(main, 0, -5), positionParams(main, 100, 100)} {
+		cl.call("textDocument/hover", p, nil)
+		cl.call("textDocument/definition", p, nil)
+		cl.call("textDocument/completion", p, nil)
+	}
+
+	cl.call("shutdown", nil, nil)
+	cl.notify("exit", nil)
+	if err := <-cl.done; err != nil {
+		t.Errorf("server returned %v", err)
+	}
+}
@@ -13,6 +13,12 @@ const (
 	ReadNormal ReadMode = iota
 	ReadComment
 	ReadString
+	// ReadQuotes follows an empty string, which a third quote makes the
+	// start of a raw string
+	ReadQuotes
+	ReadRawString
+	ReadBlockComment
+	ReadChar
 )
 
 var identRegexp = regexp.MustCompile(`^[\w\$!\+\-=<>\*\/](?:(?:\/|-)[\d\w]|[\d\w_\$])*[\?!\*]?(\.\.\.)?$`)
@@ -26,7 +32,48 @@ func isSymbol(token string) bool {
 	return symbolRegexp.MatchString(token)
 }
 
+// charNames are the characters written by name, as in '#\space'.
+var charNames = map[string]rune{
+	"space":   ' ',
+	"newline": '\n',
+	"tab":     '\t',
+	"return":  '\r',
+}
+
+func readChar(input string) (Value, error) {
+	if r := []rune(input); len(r) == 1 {
+		return Atom{t: "char", value: r[0]}, nil
+	}
+	if r, ok := charNames[input]; ok {
+		return Atom{t: "char", value: r}, nil
+	}
+	return nil, fmt.Errorf("Invalid character '#\\%s'", input)
+}
+
+func charString(r rune) string {
+	for name, c := range charNames {
+		if c == r {
+			return "#\\" + name
+		}
+	}
+	return "#\\" + string(r)
+}
+
 func categorize(input string) (Value, error) {
+	// strings come first, as they may contain anything the checks below
+	// look for
+	if len(input) > 1 && input[0] == '"' && input[len(input)-1] == '"' {
+		return Atom{
+			t:     "string",
+			value: input[1 : len(input)-1],
+		}, nil
+	}
+	if strings.HasPrefix(input, "#\\") {
+		return readChar(input[2:])
+	}
+	if strings.HasPrefix(input, "#<") {
+		return nil, fmt.Errorf("Cannot read unreadable value '%s'", input)
+	}
 	if strings.HasSuffix(input, "...") {
 		if isIdentifier(input[:len(input)-3]) {
 			return Atom{
@@ -81,12 +128,7 @@ func categorize(input string) (Value, error) {
 		}, nil
 	}
 
-	if input[0] == '"' && input[len(input)-1] == '"' {
-		return Atom{
-			t:     "string",
-			value: input[1 : len(input)-1],
-		}, nil
-	} else if isIdentifier(input) {
+	if isIdentifier(input) {
 		return Atom{
 			t:     "identifier",
 			value: input,
@@ -101,148 +143,415 @@ func categorize(input string) (Value, error) {
 	return nil, fmt.Errorf("Invalid token '%s'", input)
 }
 
+// Pos is the location of a token or form in its source.
+type Pos struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Pos) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+// ParseError is returned by Parse and ParseFile, giving where in the source
+// parsing stopped. Its message leaves the position out, as Pos does not know
+// the file when the source isn't one.
+type ParseError struct {
+	Pos Pos
+	Msg string
+	// Incomplete is set when the source ended inside a string, list or
+	// hash, so that more of it could still be parsed.
+	Incomplete bool
+}
+
+func (e *ParseError) Error() string {
+	return e.Msg
+}
+
 func Tokenize(input string) []string {
-	tokens := []string{}
-	tok := []rune{}
-	mode := ReadNormal
+	return tokenize(input).tokens
+}
+
+// Incomplete reports whether src ends inside a string or an unclosed list or
+// hash, so that more input is needed before it can be parsed.
+func Incomplete(src string) bool {
+	r := NewReader(strings.NewReader(src), "")
+	for {
+		_, err := r.Read()
+		if err != nil {
+			pe, ok := err.(*ParseError)
+			return ok && pe.Incomplete
+		}
+	}
+}
 
+// tokenize splits input into tokens, returning the scanner holding them
+// and the starting position of each.
+func tokenize(input string) *scanner {
+	s := newScanner()
 	for _, c := range input {
-		switch mode {
-		case ReadComment:
-			if c == '\n' {
-				mode = ReadNormal
-			}
-		case ReadString:
-			if c == '"' && len(tok) > 0 && (tok[len(tok)-1] != '\\') {
-				mode = ReadNormal
-				if len(tok) > 0 {
-					tokens = append(tokens, string(tok))
-					tok = []rune{}
-				}
-			} else if len(tok) > 0 && tok[len(tok)-1] == '\\' {
-				switch c {
-				case 'n':
-					tok = tok[:len(tok)-1]
-					c = '\n'
-				case 't':
-					tok = tok[:len(tok)-1]
-					c = '\t'
-				case 'r':
-					tok = tok[:len(tok)-1]
-					c = '\r'
-				}
-			}
-			tok = append(tok, c)
-		case ReadNormal:
+		s.next(c)
+	}
+	s.flush()
+	return s
+}
+
+// scanner splits runes into tokens as they arrive, queueing each token and
+// its starting position once it is complete.
+type scanner struct {
+	tokens    []string
+	positions []Pos
+	tok       []rune
+	mode      ReadMode
+	escaped   bool
+	// quote is where the string being read starts in tok, after any prefix
+	quote int
+	// depth is how deeply block comments are nested, or the quotes in a
+	// row read in a raw string
+	depth     int
+	last      rune
+	line, col int
+	start     Pos
+}
+
+func newScanner() *scanner {
+	return &scanner{line: 1}
+}
+
+func (s *scanner) push(c rune) {
+	if len(s.tok) == 0 {
+		s.start = Pos{Line: s.line, Col: s.col}
+	}
+	s.tok = append(s.tok, c)
+}
+
+func (s *scanner) emit() {
+	s.tokens = append(s.tokens, string(s.tok))
+	s.positions = append(s.positions, s.start)
+	s.tok = []rune{}
+}
+
+// unclosed returns the error for input ending inside a string or block
+// comment, if it has.
+func (s *scanner) unclosed(file string) error {
+	pos := s.start
+	pos.File = file
+	switch s.mode {
+	case ReadString, ReadRawString:
+		return &ParseError{Pos: pos, Msg: "Unclosed string", Incomplete: true}
+	case ReadBlockComment:
+		return &ParseError{Pos: pos, Msg: "Unclosed '#|'", Incomplete: true}
+	}
+	return nil
+}
+
+// flush queues the token being read, as the input has ended.
+func (s *scanner) flush() {
+	if len(s.tok) > 0 {
+		s.emit()
+	}
+}
+
+func (s *scanner) next(c rune) {
+	if c == '\n' {
+		s.line++
+		s.col = 0
+	} else {
+		s.col++
+	}
+	s.read(c)
+}
+
+// tagged reports whether the token being read is a reader macro's '#name',
+// which the form following it without a space is given to.
+func (s *scanner) tagged() bool {
+	return len(s.tok) > 1 && s.tok[0] == '#' && string(s.tok) != "#_" && isIdentifier(string(s.tok[1:]))
+}
+
+func (s *scanner) read(c rune) {
+	switch s.mode {
+	case ReadComment:
+		if c == '\n' {
+			s.mode = ReadNormal
+		}
+	case ReadBlockComment:
+		if s.last == '|' && c == '#' {
+			s.depth--
+			c = 0
+		} else if s.last == '#' && c == '|' {
+			s.depth++
+			c = 0
+		}
+		s.last = c
+		if s.depth == 0 {
+			s.mode = ReadNormal
+		}
+	case ReadChar:
+		s.push(c)
+		s.mode = ReadNormal
+	case ReadString:
+		if s.escaped {
+			s.escaped = false
 			switch c {
-			// don't add char, do add token
-			case '\n':
-			case '\t':
-			case ' ':
-				break
-			case ';':
-				mode = ReadComment
-				continue
-			case '"':
-				mode = ReadString
-				tok = append(tok, c)
-				continue
-			case '(':
-				if len(tok) > 0 && tok[len(tok)-1] != '\'' {
-					tokens = append(tokens, string(tok))
-					tok = []rune{}
-				}
-				tok = append(tok, c)
-			case ')':
-				if len(tok) > 0 {
-					tokens = append(tokens, string(tok))
-					tok = []rune{}
-				}
-				tok = append(tok, c)
-			case '[':
-				continue
-			case ']':
-				continue
-			case '{':
-				if len(tok) > 0 {
-					tokens = append(tokens, string(tok))
-					tok = []rune{}
-				}
-				tok = append(tok, c)
-			case '}':
-				if len(tok) > 0 {
-					tokens = append(tokens, string(tok))
-					tok = []rune{}
-				}
-				tok = append(tok, c)
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case 'r':
+				c = '\r'
+			case '"', '\\':
 			default:
-				tok = append(tok, c)
-				continue
+				s.push('\\')
 			}
-			if len(tok) > 0 {
-				tokens = append(tokens, string(tok))
-				tok = []rune{}
+		} else if c == '\\' {
+			s.escaped = true
+			return
+		} else if c == '"' {
+			s.push(c)
+			if len(s.tok) == s.quote+2 {
+				s.mode = ReadQuotes
+				return
 			}
+			s.mode = ReadNormal
+			s.emit()
+			return
 		}
+		s.push(c)
+	case ReadQuotes:
+		if c == '"' {
+			s.tok = s.tok[:s.quote+1]
+			s.mode = ReadRawString
+			s.depth = 0
+			return
+		}
+		s.mode = ReadNormal
+		s.emit()
+		s.read(c)
+	case ReadRawString:
+		// depth counts the quotes read in a row, which are only added to
+		// the string once they are known not to end it
+		if c == '"' {
+			s.depth++
+			if s.depth == 3 {
+				s.mode = ReadNormal
+				s.push(c)
+				s.emit()
+			}
+			return
+		}
+		for ; s.depth > 0; s.depth-- {
+			s.push('"')
+		}
+		s.push(c)
+	case ReadNormal:
+		switch c {
+		// don't add char, do add token
+		case '\n':
+		case '\t':
+		case ' ':
+			break
+		case ';':
+			s.mode = ReadComment
+			return
+		case '"':
+			s.mode = ReadString
+			s.quote = len(s.tok)
+			s.push(c)
+			return
+		case '(':
+			if len(s.tok) > 0 && s.tok[len(s.tok)-1] != '\'' && !s.tagged() {
+				s.emit()
+			}
+			s.push(c)
+		case ')':
+			if len(s.tok) > 0 {
+				s.emit()
+			}
+			s.push(c)
+		case '[':
+			return
+		case ']':
+			return
+		case '{':
+			if len(s.tok) > 0 && !s.tagged() {
+				s.emit()
+			}
+			s.push(c)
+		case '}':
+			if len(s.tok) > 0 {
+				s.emit()
+			}
+			s.push(c)
+		default:
+			s.push(c)
+			switch string(s.tok) {
+			case "#|":
+				s.tok = s.tok[:0]
+				s.mode, s.depth, s.last = ReadBlockComment, 1, 0
+			case "#\\":
+				s.mode = ReadChar
+			case "#_":
+				s.emit()
+			}
+			return
+		}
+		s.flush()
 	}
-	if len(tok) > 0 {
-		tokens = append(tokens, string(tok))
-	}
-	return tokens
 }
 
 func Parse(tokens []string) ([]Value, error) {
+	return parse(tokens, nil, "")
+}
+
+// ParseFile parses src, recording the position of each list within file.
+func ParseFile(file string, src string) ([]Value, error) {
+	s := tokenize(src)
+	if err := s.unclosed(file); err != nil {
+		return nil, err
+	}
+	return parse(s.tokens, s.positions, file)
+}
+
+func parse(tokens []string, positions []Pos, file string) ([]Value, error) {
 	var output []Value
-	var stack []Container
-
-	for _, token := range tokens {
-		if token == "'(" {
-			stack = append(stack, &List{Quoted: true})
-		} else if token == "(" {
-			stack = append(stack, &List{})
-		} else if token == ")" {
-			s := stack[len(stack)-1]
-			stack = stack[:len(stack)-1]
-			n := len(stack)
-
-			if n > 0 {
-				stack[n-1].Append(s)
-			} else {
-				output = append(output, s)
-			}
-		} else if token == "{" {
-			stack = append(stack, &Hash{
-				pairs:    []Value{},
-				sym_vals: make(map[string]Value),
-				vals:     make(map[string]Value),
-			})
-		} else if token == "}" {
-			if stack[len(stack)-1].Type() != "hash" {
-				return nil, fmt.Errorf("Unexpected token '}' (no matching open bracket).")
-			}
+	p := &parser{}
+	for i, token := range tokens {
+		var pos Pos
+		if i < len(positions) {
+			pos = positions[i]
+			pos.File = file
+		}
+		v, err := p.push(token, pos)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			output = append(output, v)
+		}
+	}
+	if err := p.end(); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
 
-			s := stack[len(stack)-1].(*Hash)
-			stack = stack[:len(stack)-1]
-			n := len(stack)
+// parser builds forms from tokens as they arrive.
+type parser struct {
+	stack []frame
+}
 
-			if n > 0 {
-				stack[n-1].Append(s)
-			} else {
-				output = append(output, s)
-			}
-		} else {
-			s, err := categorize(token)
-			if err != nil {
-				return nil, err
-			}
+// frame is a list or hash being read, or a prefix waiting on the form after
+// it: a quote, a '#_' discarding it or a reader macro.
+type frame struct {
+	c      Container
+	prefix string
+	pos    Pos
+}
 
-			n := len(stack)
-			if n > 0 {
-				stack[n-1].Append(s)
-			} else {
-				return []Value{s}, nil
-			}
+// push adds the token at pos to the form being read, returning the form
+// once it is complete.
+func (p *parser) push(token string, pos Pos) (Value, error) {
+	var s Value
+	switch {
+	case token == "'(":
+		p.stack = append(p.stack, frame{c: &List{Quoted: true, pos: pos}, pos: pos})
+		return nil, nil
+	case token == "(":
+		p.stack = append(p.stack, frame{c: &List{pos: pos}, pos: pos})
+		return nil, nil
+	case token == "{":
+		p.stack = append(p.stack, frame{c: &Hash{
+			pairs:    []Value{},
+			sym_vals: make(map[string]Value),
+			vals:     make(map[string]Value),
+		}, pos: pos})
+		return nil, nil
+	case token == ")" || token == "}":
+		kind, msg := "list", "Unexpected token ')' (no matching open paren)."
+		if token == "}" {
+			kind, msg = "hash", "Unexpected token '}' (no matching open bracket)."
+		}
+		n := len(p.stack)
+		if n > 0 && p.stack[n-1].c == nil {
+			return nil, p.fail(&ParseError{Pos: pos, Msg: fmt.Sprintf("Expected a form after '%s'", p.stack[n-1].prefix)})
+		}
+		if n == 0 || p.stack[n-1].c.Type() != kind {
+			return nil, p.fail(&ParseError{Pos: pos, Msg: msg})
+		}
+		s = p.stack[n-1].c
+		p.stack = p.stack[:n-1]
+	case token == "'" || token == "#_":
+		p.stack = append(p.stack, frame{prefix: token, pos: pos})
+		return nil, nil
+	case strings.HasPrefix(token, "'"):
+		p.stack = append(p.stack, frame{prefix: "'", pos: pos})
+		return p.push(token[1:], pos)
+	case strings.HasPrefix(token, "#") && strings.ContainsAny(token, "\"({"):
+		i := strings.IndexAny(token, "\"({")
+		if i > 1 && isIdentifier(token[1:i]) {
+			p.stack = append(p.stack, frame{prefix: token[:i], pos: pos})
+			return p.push(token[i:], pos)
+		}
+		fallthrough
+	default:
+		var err error
+		if s, err = categorize(token); err != nil {
+			return nil, p.fail(&ParseError{Pos: pos, Msg: err.Error()})
 		}
 	}
-	return output, nil
+	return p.add(s), nil
+}
+
+// add gives a complete form to the innermost list or hash being read, after
+// applying the prefixes before it, and returns it if it is at the top level.
+func (p *parser) add(v Value) Value {
+	for len(p.stack) > 0 {
+		top := p.stack[len(p.stack)-1]
+		if top.c != nil {
+			top.c.Append(v)
+			return nil
+		}
+		p.stack = p.stack[:len(p.stack)-1]
+		switch top.prefix {
+		case "#_":
+			return nil
+		case "'":
+			v = &List{children: []Value{Atom{t: "identifier", value: "quote"}, v}, pos: top.pos}
+		default:
+			v = &List{children: []Value{Atom{t: "identifier", value: "reader-macro"}, Atom{t: "identifier", value: top.prefix[1:]}, v}, pos: top.pos}
+		}
+	}
+	return v
+}
+
+// fail drops the form being read, so that reading can carry on after err.
+func (p *parser) fail(err error) error {
+	p.stack = nil
+	return err
+}
+
+// end returns an error if the input ended inside a form.
+func (p *parser) end() error {
+	n := len(p.stack)
+	if n == 0 {
+		return nil
+	}
+	top := p.stack[n-1]
+	open := top.prefix
+	if top.c != nil {
+		open = "("
+		if top.c.Type() == "hash" {
+			open = "{"
+		}
+		return p.fail(&ParseError{Pos: top.pos, Msg: fmt.Sprintf("Unclosed '%s'", open), Incomplete: true})
+	}
+	return p.fail(&ParseError{Pos: top.pos, Msg: fmt.Sprintf("Expected a form after '%s'", open), Incomplete: true})
 }
@@ -0,0 +1,110 @@
+package sigmo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var stringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`, "\r", `\r`)
+
+// quoteString writes s as a string literal that reads back as s.
+func quoteString(s string) string {
+	return `"` + stringEscaper.Replace(s) + `"`
+}
+
+// display writes v as print, println and string do: strings and characters
+// as they are, times and durations in their usual text form, and anything
+// else as it reads.
+func display(v Value) string {
+	switch x := v.(type) {
+	case Atom:
+		switch x.t {
+		case "string":
+			return x.value.(string)
+		case "char":
+			return string(x.value.(rune))
+		}
+	case *Time:
+		return x.t.Format(time.RFC3339Nano)
+	case *Duration:
+		return x.d.String()
+	}
+	return v.String()
+}
+
+// formatFloat writes f in as few digits as read back to the same float,
+// keeping a decimal point so that it doesn't read back as an int.
+func formatFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
+
+// Pretty writes v like String, but breaks lists and hashes that don't fit in
+// width columns over several lines. Lists starting with an identifier are
+// indented like code, keeping their first argument beside the head; others
+// are aligned under their first element.
+func Pretty(v Value, width int) string {
+	return pretty(v, 0, width)
+}
+
+func pretty(v Value, indent int, width int) string {
+	flat := v.String()
+	if indent+len(flat) <= width {
+		return flat
+	}
+	switch x := v.(type) {
+	case *List:
+		if len(x.children) == 0 {
+			return flat
+		}
+		open := "("
+		if x.Quoted {
+			open = "'("
+		}
+		step, rest := indent+len(open), x.children[1:]
+		first := open + pretty(x.children[0], step, width)
+		if x.children[0].Type() == "identifier" && len(rest) > 0 {
+			first += " " + pretty(rest[0], indent+len(first)+1, width)
+			step, rest = indent+2, rest[1:]
+		}
+		lines := []string{first}
+		for _, c := range rest {
+			lines = append(lines, strings.Repeat(" ", step)+pretty(c, step, width))
+		}
+		return strings.Join(lines, "\n") + ")"
+	case *Hash:
+		entries := x.entries()
+		if len(entries) == 0 {
+			return flat
+		}
+		lines := []string{}
+		for i := 0; i < len(entries); i += 2 {
+			k := entries[i].String()
+			line := strings.Repeat(" ", indent+1) + k
+			if i+1 < len(entries) {
+				line += " " + pretty(entries[i+1], indent+2+len(k), width)
+			}
+			lines = append(lines, line)
+		}
+		lines[0] = "{" + lines[0][indent+1:]
+		return strings.Join(lines, "\n") + "}"
+	}
+	return flat
+}
+
+func pprintFunction(input *List, c Context) Value {
+	width := 80
+	if len(input.children) > 1 {
+		if input.children[1].Type() != "int" {
+			return Atom{t: "error", value: fmt.Sprintf("Function 'pprint' cannot have '%s' as argtype, expected 'int'.", input.children[1].Type())}
+		}
+		width = input.children[1].Value().(int)
+	}
+	fmt.Println(Pretty(input.children[0], width))
+	return NIL
+}
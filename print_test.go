@@ -0,0 +1,204 @@
+package sigmo
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// equalValues compares values as read, so hashes by the pairs they were
+// written with.
+func equalValues(a, b Value) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch x := a.(type) {
+	case *List:
+		y := b.(*List)
+		if x.Quoted != y.Quoted || len(x.children) != len(y.children) {
+			return false
+		}
+		for i := range x.children {
+			if !equalValues(x.children[i], y.children[i]) {
+				return false
+			}
+		}
+		return true
+	case *Hash:
+		return equalValues(&List{children: x.pairs}, &List{children: b.(*Hash).pairs})
+	}
+	return Compare(a, b)
+}
+
+var (
+	testIdentifiers = []string{"x", "foo-bar", "a1", "set!", "empty?", "+", "ns/name", "x_y"}
+	testSymbols     = []string{":a", ":key", ":a-b", ":x1"}
+	testRunes       = []rune{'a', 'Z', '0', ' ', '"', '\\', '\n', '\t', '\r', ';', '(', ')', '{', '}', '#', '|', '\'', 'é', '日', '🙂'}
+)
+
+func randomString(r *rand.Rand) string {
+	runes := make([]rune, r.Intn(12))
+	for i := range runes {
+		runes[i] = testRunes[r.Intn(len(testRunes))]
+	}
+	return string(runes)
+}
+
+func randomFloat(r *rand.Rand) float64 {
+	switch r.Intn(6) {
+	case 0:
+		return float64(r.Intn(100))
+	case 1:
+		return math.Inf(1 - 2*r.Intn(2))
+	case 2:
+		return r.NormFloat64() * math.Pow(10, float64(r.Intn(60)-30))
+	}
+	return r.NormFloat64() * 1000
+}
+
+func randomAtom(r *rand.Rand) Value {
+	switch r.Intn(9) {
+	case 0:
+		return Atom{t: "int", value: r.Intn(2000000) - 1000000}
+	case 1:
+		return Atom{t: "float", value: randomFloat(r)}
+	case 2:
+		return Atom{t: "string", value: randomString(r)}
+	case 3:
+		return Atom{t: "identifier", value: testIdentifiers[r.Intn(len(testIdentifiers))]}
+	case 4:
+		return Atom{t: "symbol", value: testSymbols[r.Intn(len(testSymbols))]}
+	case 5:
+		return Atom{t: "char", value: testRunes[r.Intn(len(testRunes))]}
+	case 6:
+		return Atom{t: "type", value: testIdentifiers[r.Intn(3)]}
+	case 7:
+		return []Value{TRUE, FALSE, NIL}[r.Intn(3)]
+	}
+	return Atom{t: "int", value: r.Intn(10)}
+}
+
+// randomValue makes a value of the kinds the reader produces, nesting lists,
+// quoted lists, quote forms and hashes up to depth deep.
+func randomValue(r *rand.Rand, depth int) Value {
+	if depth == 0 || r.Intn(3) == 0 {
+		return randomAtom(r)
+	}
+	switch r.Intn(4) {
+	case 0:
+		h := &Hash{vals: make(map[string]Value), sym_vals: make(map[string]Value)}
+		for i := r.Intn(4); i > 0; i-- {
+			k := Atom{t: "string", value: randomString(r)}
+			if r.Intn(2) == 0 {
+				k = Atom{t: "symbol", value: testSymbols[r.Intn(len(testSymbols))]}
+			}
+			h.pairs = append(h.pairs, k, randomValue(r, depth-1))
+		}
+		return h
+	case 1:
+		return &List{children: []Value{Atom{t: "identifier", value: "quote"}, randomValue(r, depth-1)}}
+	}
+	l := &List{Quoted: r.Intn(3) == 0}
+	for i := r.Intn(5); i > 0; i-- {
+		l.children = append(l.children, randomValue(r, depth-1))
+	}
+	return l
+}
+
+func TestPrintReadsBack(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		v := randomValue(r, 4)
+		src := v.String()
+		nodes, err := Parse(Tokenize(src))
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		if len(nodes) != 1 || !equalValues(v, nodes[0]) {
+			t.Fatalf("%s read back as %v", src, nodes)
+		}
+	}
+}
+
+func TestPrettyReadsBack(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 1000; i++ {
+		v := randomValue(r, 5)
+		src := Pretty(v, 20)
+		nodes, err := Parse(Tokenize(src))
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		if len(nodes) != 1 || !equalValues(v, nodes[0]) {
+			t.Fatalf("%s read back as %v", src, nodes)
+		}
+	}
+}
+
+func TestPrintExamples(t *testing.T) {
+	for _, tc := range []struct {
+		v    Value
+		want string
+	}{
+		{Atom{t: "float", value: 1.0}, "1.0"},
+		{Atom{t: "float", value: 1e21}, "1e+21"},
+		{Atom{t: "string", value: "a \"b\"\n\\"}, `"a \"b\"\n\\"`},
+		{Atom{t: "char", value: ' '}, `#\space`},
+		{&List{Quoted: true, children: []Value{Atom{t: "int", value: 1}}}, "'(1)"},
+	} {
+		if got := tc.v.String(); got != tc.want {
+			t.Errorf("got %s, want %s", got, tc.want)
+		}
+	}
+}
+
+// TestPrintUnreadable checks values with no literal form print as '#<...>',
+// which the reader rejects.
+func TestPrintUnreadable(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `(def sq (lambda (x) (* x x))) (defgeneric area (x)) (macro twice (x) (do x x))`)
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`sq`, "#<fn sq>"},
+		{`(lambda (x) x)`, "#<fn anonymous>"},
+		{`+`, "#<fn +>"},
+		{`area`, "#<generic area>"},
+		{`twice`, "#<macro twice>"},
+		{`(range)`, "#<seq>"},
+		{`(chan)`, "#<chan>"},
+		{`(spawn (lambda () 1))`, "#<future>"},
+		{`(ref '(1 "a"))`, `#<ref '(1 "a")>`},
+		{`(cons sq '(1))`, "(#<fn sq> 1)"},
+		{`(time/duration "1.5s")`, "#<duration 1.5s>"},
+		{`(time/utc (time/from-unix 0))`, "#<time 1970-01-01T00:00:00Z>"},
+	} {
+		src := evalString(t, c, tc.src).String()
+		if src != tc.want {
+			t.Errorf("%s printed as %s, want %s", tc.src, src, tc.want)
+		}
+		if nodes, err := Parse(Tokenize(src)); err == nil {
+			t.Errorf("%s read back as %v, want an error", src, nodes)
+		}
+	}
+}
+
+func TestDisplay(t *testing.T) {
+	for _, tc := range []struct {
+		v    Value
+		want string
+	}{
+		{Atom{t: "char", value: 'a'}, "a"},
+		{Atom{t: "char", value: ' '}, " "},
+		{Atom{t: "string", value: "a \"b\""}, `a "b"`},
+		{Atom{t: "int", value: 1}, "1"},
+		{&Duration{d: 1500 * time.Millisecond}, "1.5s"},
+		{&List{Quoted: true, children: []Value{Atom{t: "char", value: 'c'}, Atom{t: "string", value: "d"}}}, `'(#\c "d")`},
+	} {
+		if got := display(tc.v); got != tc.want {
+			t.Errorf("display(%s) = %q, want %q", tc.v, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package sigmo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type profileFunc struct {
+	id        int
+	name      string
+	pos       Pos
+	calls     int64
+	inclusive time.Duration
+	exclusive time.Duration
+	// active is how many calls to the function are in progress, so that
+	// the inclusive time of recursive calls is only counted once
+	active int
+}
+
+type profileFrame struct {
+	fn       *profileFunc
+	start    time.Time
+	children time.Duration
+	// key identifies the stack of functions this frame is the top of
+	key string
+}
+
+type profileSample struct {
+	stack []*profileFunc
+	calls int64
+	self  time.Duration
+}
+
+// Profiler is a DebugHook counting the calls of each function, macro and
+// generic, and the time spent in them both including and excluding the
+// functions they call. Functions are told apart by their names and where
+// they were defined. Time spent outside of any function is put down to
+// 'top level'.
+//
+// Like Debugger, it keeps a single stack, so the time of spawned tasks is
+// counted against the functions that were running when they were.
+type Profiler struct {
+	mu      sync.Mutex
+	start   time.Time
+	end     time.Time
+	funcs   map[string]*profileFunc
+	order   []*profileFunc
+	calls   []*profileFrame
+	lists   []bool
+	samples map[string]*profileSample
+	keys    []string
+}
+
+// NewProfiler returns a Profiler timing from now until Stop is called.
+func NewProfiler() *Profiler {
+	p := &Profiler{start: time.Now(), funcs: make(map[string]*profileFunc), samples: make(map[string]*profileSample)}
+	top := p.function("top level", Pos{})
+	top.calls, top.active = 1, 1
+	p.calls = []*profileFrame{{fn: top, start: p.start, key: "1"}}
+	return p
+}
+
+func (p *Profiler) function(name string, pos Pos) *profileFunc {
+	key := name + " " + pos.String()
+	fn, ok := p.funcs[key]
+	if !ok {
+		fn = &profileFunc{id: len(p.order) + 1, name: name, pos: pos}
+		p.funcs[key] = fn
+		p.order = append(p.order, fn)
+	}
+	return fn
+}
+
+// called returns the function form calls, or nil if it isn't a call.
+func (p *Profiler) called(form *List, c Context) *profileFunc {
+	if len(form.children) == 0 || form.children[0].Type() != "identifier" {
+		return nil
+	}
+	name := form.children[0].Value().(string)
+	if _, ok := specialForms[name]; ok {
+		return nil
+	}
+	return p.callee(name, c.Get(name))
+}
+
+// callee returns the function v, called by name, or nil if it isn't one.
+func (p *Profiler) callee(name string, v Value) *profileFunc {
+	var source *List
+	switch x := v.(type) {
+	case Function:
+		source = x.source
+		if x.name != "" {
+			name = x.name
+		}
+	case Macro:
+		source = x.source
+	case *Generic:
+		name = x.name
+	default:
+		return nil
+	}
+	pos := Pos{}
+	if source != nil {
+		pos = source.pos
+	}
+	return p.function(name, pos)
+}
+
+// enter starts a call of fn.
+func (p *Profiler) enter(fn *profileFunc) {
+	parent := p.calls[len(p.calls)-1]
+	fn.active++
+	p.calls = append(p.calls, &profileFrame{fn: fn, start: time.Now(), key: parent.key + "," + strconv.Itoa(fn.id)})
+}
+
+func (p *Profiler) Enter(form *List, c Context) Value {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.end.IsZero() {
+		return nil
+	}
+	fn := p.called(form, c)
+	p.lists = append(p.lists, fn != nil)
+	if fn != nil {
+		p.enter(fn)
+	}
+	return nil
+}
+
+func (p *Profiler) Leave(form *List, c Context, result Value) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(p.lists)
+	if n == 0 || !p.end.IsZero() {
+		return
+	}
+	call := p.lists[n-1]
+	p.lists = p.lists[:n-1]
+	if call && len(p.calls) > 1 {
+		p.leave(time.Now())
+	}
+}
+
+// EnterCall counts the calls builtins make to the functions they are given,
+// such as those passed to map or sort.
+func (p *Profiler) EnterCall(fn Value, c Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.end.IsZero() {
+		return
+	}
+	p.enter(p.callee("anonymous", fn))
+}
+
+func (p *Profiler) LeaveCall(fn Value, c Context, result Value) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.end.IsZero() && len(p.calls) > 1 {
+		p.leave(time.Now())
+	}
+}
+
+// leave ends the innermost call.
+func (p *Profiler) leave(now time.Time) {
+	f := p.calls[len(p.calls)-1]
+	elapsed := now.Sub(f.start)
+	self := elapsed - f.children
+	s, ok := p.samples[f.key]
+	if !ok {
+		s = &profileSample{}
+		for i := len(p.calls) - 1; i >= 0; i-- {
+			s.stack = append(s.stack, p.calls[i].fn)
+		}
+		p.samples[f.key] = s
+		p.keys = append(p.keys, f.key)
+	}
+	s.calls++
+	s.self += self
+
+	p.calls = p.calls[:len(p.calls)-1]
+	if len(p.calls) > 0 {
+		p.calls[len(p.calls)-1].children += elapsed
+	} else {
+		// the top level isn't counted as a call
+		s.calls--
+	}
+	f.fn.active--
+	f.fn.exclusive += self
+	if f.fn.active == 0 {
+		f.fn.inclusive += elapsed
+	}
+	if f.fn.id != 1 {
+		f.fn.calls++
+	}
+}
+
+// Stop ends the profile, along with any calls still in progress.
+func (p *Profiler) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.end.IsZero() {
+		return
+	}
+	p.end = time.Now()
+	for len(p.calls) > 0 {
+		p.leave(p.end)
+	}
+}
+
+// Report writes a table of the functions called, with the most time spent
+// in them alone first.
+func (p *Profiler) Report(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	funcs := append([]*profileFunc{}, p.order[1:]...)
+	sort.SliceStable(funcs, func(i, j int) bool { return funcs[i].exclusive > funcs[j].exclusive })
+	fmt.Fprintf(w, "%10s %12s %12s  %s\n", "calls", "inclusive", "exclusive", "function")
+	for _, fn := range funcs {
+		where := ""
+		if fn.pos.IsValid() {
+			where = "  " + fn.pos.String()
+		}
+		fmt.Fprintf(w, "%10d %12s %12s  %s%s\n", fn.calls, fn.inclusive.Round(time.Microsecond), fn.exclusive.Round(time.Microsecond), fn.name, where)
+	}
+}
+
+// WriteProfile writes the profile in the gzipped protocol buffer format read
+// by 'go tool pprof'. Each sample is a stack of calls, valued by the number
+// of calls made with that stack and the time spent at the top of it.
+func (p *Profiler) WriteProfile(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	strs := map[string]int{"": 0}
+	table := []string{""}
+	str := func(s string) uint64 {
+		i, ok := strs[s]
+		if !ok {
+			i = len(table)
+			strs[s] = i
+			table = append(table, s)
+		}
+		return uint64(i)
+	}
+
+	out := &protobuf{}
+	valueType := func(field int, typ, unit string) {
+		m := &protobuf{}
+		m.uint(1, str(typ))
+		m.uint(2, str(unit))
+		out.message(field, m)
+	}
+	valueType(1, "calls", "count")
+	valueType(1, "time", "nanoseconds")
+	for _, key := range p.keys {
+		s := p.samples[key]
+		m := &protobuf{}
+		ids := []uint64{}
+		for _, fn := range s.stack {
+			ids = append(ids, uint64(fn.id))
+		}
+		m.packed(1, ids)
+		m.packed(2, []uint64{uint64(s.calls), uint64(s.self.Nanoseconds())})
+		out.message(2, m)
+	}
+	for _, fn := range p.order {
+		line := &protobuf{}
+		line.uint(1, uint64(fn.id))
+		line.uint(2, uint64(fn.pos.Line))
+		loc := &protobuf{}
+		loc.uint(1, uint64(fn.id))
+		loc.message(4, line)
+		out.message(4, loc)
+	}
+	for _, fn := range p.order {
+		m := &protobuf{}
+		m.uint(1, uint64(fn.id))
+		m.uint(2, str(fn.name))
+		m.uint(3, str(fn.name))
+		m.uint(4, str(fn.pos.File))
+		m.uint(5, uint64(fn.pos.Line))
+		out.message(5, m)
+	}
+	valueType(11, "time", "nanoseconds")
+	out.uint(12, 1)
+	out.uint(9, uint64(p.start.UnixNano()))
+	out.uint(10, uint64(p.end.Sub(p.start).Nanoseconds()))
+	for _, s := range table {
+		out.bytes(6, []byte(s))
+	}
+
+	z := gzip.NewWriter(w)
+	if _, err := z.Write(out.Bytes()); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// protobuf encodes the fields of a protocol buffer message.
+type protobuf struct {
+	bytes.Buffer
+}
+
+func (b *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.WriteByte(byte(x))
+}
+
+func (b *protobuf) uint(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.varint(uint64(field) << 3)
+	b.varint(x)
+}
+
+func (b *protobuf) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+func (b *protobuf) packed(field int, xs []uint64) {
+	m := &protobuf{}
+	for _, x := range xs {
+		m.varint(x)
+	}
+	b.bytes(field, m.Bytes())
+}
+
+func (b *protobuf) message(field int, m *protobuf) {
+	b.bytes(field, m.Bytes())
+}
+
+// profileForm evaluates an expression with a Profiler, printing its report
+// and, when given a file name, writing the profile to it.
+func profileForm(form *List, c Context) Value {
+	if len(form.children) < 2 || len(form.children) > 3 {
+		return Atom{t: "error", value: "Wrong number of arguments to 'profile'"}
+	}
+	file := ""
+	if len(form.children) == 3 {
+		f := form.children[2].Eval(c)
+		if f.Type() != "string" {
+			return Atom{t: "error", value: fmt.Sprintf("profile expected argument 1 of type 'string', got type '%s'", f.Type())}
+		}
+		file = f.Value().(string)
+	}
+	p := NewProfiler()
+	prev := currentHook()
+	SetDebugHook(p)
+	v := form.children[1].Eval(c)
+	SetDebugHook(prev)
+	p.Stop()
+	p.Report(os.Stdout)
+	if file != "" {
+		buf := &bytes.Buffer{}
+		if err := p.WriteProfile(buf); err != nil {
+			return Atom{t: "error", value: err.Error()}
+		}
+		if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			return Atom{t: "error", value: err.Error()}
+		}
+	}
+	return v
+}
@@ -0,0 +1,27 @@
+package sigmo
+
+import "testing"
+
+// TestProfileCallbacks counts the calls map and sort make to the functions
+// passed to them.
+func TestProfileCallbacks(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `(def sq (lambda (x) (* x x)))`)
+	p := NewProfiler()
+	prev := currentHook()
+	SetDebugHook(p)
+	evalString(t, c, `(map sq '(1 2 3)) (sort > '(3 1 2))`)
+	SetDebugHook(prev)
+	p.Stop()
+
+	calls := make(map[string]int64)
+	for _, fn := range p.order {
+		calls[fn.name] += fn.calls
+	}
+	if calls["sq"] != 3 || calls["*"] != 3 || calls["map"] != 1 {
+		t.Errorf("calls are %v, want 3 of sq and *, and 1 of map", calls)
+	}
+	if calls["gt"] < 2 {
+		t.Errorf("sort called > %d times, want at least 2", calls["gt"])
+	}
+}
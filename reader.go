@@ -0,0 +1,62 @@
+package sigmo
+
+import (
+	"bufio"
+	"io"
+)
+
+// Reader parses forms from an io.Reader one at a time, reading no more of
+// it than it needs to complete each one, so that a pipe or socket can be
+// evaluated form by form as it arrives.
+type Reader struct {
+	in     *bufio.Reader
+	file   string
+	scan   *scanner
+	parse  parser
+	closed bool
+}
+
+// NewReader returns a Reader parsing in, recording the position of each
+// list within file.
+func NewReader(in io.Reader, file string) *Reader {
+	return &Reader{in: bufio.NewReader(in), file: file, scan: newScanner()}
+}
+
+// Read returns the next top-level form. At the end of the input it returns
+// io.EOF, or a *ParseError with Incomplete set if the input ended inside a
+// form. After any other *ParseError, the form it was in is dropped and
+// reading carries on after the token that caused it.
+func (r *Reader) Read() (Value, error) {
+	for {
+		s := r.scan
+		for len(s.tokens) > 0 {
+			token, pos := s.tokens[0], s.positions[0]
+			s.tokens, s.positions = s.tokens[1:], s.positions[1:]
+			pos.File = r.file
+			v, err := r.parse.push(token, pos)
+			if err != nil || v != nil {
+				return v, err
+			}
+		}
+		if r.closed {
+			if err := r.parse.end(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		c, _, err := r.in.ReadRune()
+		if err == io.EOF {
+			r.closed = true
+			if err := s.unclosed(r.file); err != nil {
+				r.parse.fail(nil)
+				return nil, err
+			}
+			s.flush()
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.next(c)
+	}
+}
@@ -0,0 +1,123 @@
+package sigmo
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAll reads src form by form, describing each form with the position of
+// lists, and each error with its position and whether it is incomplete.
+func readAll(src string) []string {
+	r := NewReader(strings.NewReader(src), "f.mo")
+	out := []string{}
+	for {
+		v, err := r.Read()
+		if err == io.EOF {
+			return out
+		}
+		if pe, ok := err.(*ParseError); ok {
+			desc := pe.Pos.String() + " " + pe.Msg
+			if pe.Incomplete {
+				desc += " (incomplete)"
+			}
+			out = append(out, desc)
+			continue
+		}
+		if err != nil {
+			return append(out, err.Error())
+		}
+		if l, ok := v.(*List); ok {
+			out = append(out, v.String()+" at "+l.pos.String())
+		} else {
+			out = append(out, v.String())
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want []string
+	}{
+		{"1 (a b)\n  {\"k\" 1}", []string{"1", "(a b) at f.mo:1:3", `{"k" 1}`}},
+		{"'(x y) 'z", []string{"'(x y) at f.mo:1:1", "(quote z) at f.mo:1:8"}},
+		{`#\a #num"4"`, []string{`#\a`, `(reader-macro num "4") at f.mo:1:5`}},
+		{"(a))\n(b)", []string{"(a) at f.mo:1:1", "f.mo:1:4 Unexpected token ')' (no matching open paren).", "(b) at f.mo:2:1"}},
+		{"(a\n  (b", []string{"f.mo:2:3 Unclosed '(' (incomplete)"}},
+		{`(print "abc`, []string{"f.mo:1:8 Unclosed string (incomplete)"}},
+		{"(a #<fn>) 2", []string{"f.mo:1:4 Cannot read unreadable value '#<fn>'", "f.mo:1:9 Unexpected token ')' (no matching open paren).", "2"}},
+		{"; only a comment\n", []string{}},
+		{"", []string{}},
+	} {
+		got := readAll(tc.src)
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("reading %q:\n got %q\nwant %q", tc.src, got, tc.want)
+		}
+	}
+}
+
+// TestReaderStreams reads forms from a pipe as they are written, without
+// waiting for the input to end.
+func TestReaderStreams(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	r := NewReader(pr, "<pipe>")
+	forms := make(chan string)
+	go func() {
+		for {
+			v, err := r.Read()
+			if err != nil {
+				close(forms)
+				return
+			}
+			forms <- v.String()
+		}
+	}()
+	for _, tc := range []struct {
+		write string
+		want  string
+	}{
+		{"(+ 1", ""},
+		{" 2) (", "(+ 1 2)"},
+		{"cat \"a\" \"b\")", `(cat "a" "b")`},
+	} {
+		io.WriteString(pw, tc.write)
+		select {
+		case got := <-forms:
+			if got != tc.want {
+				t.Errorf("after writing %q, read %s, want %q", tc.write, got, tc.want)
+			}
+		case <-time.After(50 * time.Millisecond):
+			if tc.want != "" {
+				t.Errorf("after writing %q, read nothing, want %s", tc.write, tc.want)
+			}
+		}
+	}
+	pw.Close()
+	if _, ok := <-forms; ok {
+		t.Errorf("read a form after the input ended")
+	}
+}
+
+func TestReaderMatchesParseFile(t *testing.T) {
+	src := "(def x\n  (+ 1 2))\n\n(println {\"a\" '(x)})\n"
+	parsed, err := ParseFile("f.mo", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(strings.NewReader(src), "f.mo")
+	for _, want := range parsed {
+		got, err := r.Read()
+		if err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+		if got.String() != want.String() || got.(*List).pos != want.(*List).pos {
+			t.Errorf("read %s at %s, want %s at %s", got, got.(*List).pos, want, want.(*List).pos)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("read past the last form: %v, want EOF", err)
+	}
+}
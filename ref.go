@@ -0,0 +1,173 @@
+package sigmo
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Ref is a mutable cell that can be shared between goroutines. Updates made
+// with 'swap!' are atomic: the function is retried if another goroutine
+// changed the ref while it was running.
+type Ref struct {
+	mu      sync.Mutex
+	value   Value
+	version int
+	watches map[string]Value
+}
+
+func NewRef(v Value) *Ref {
+	return &Ref{value: v, watches: make(map[string]Value)}
+}
+
+func (r *Ref) String() string {
+	return unreadable("ref", r.Deref().String())
+}
+
+func (r *Ref) Eval(c Context) Value {
+	return r
+}
+
+func (r *Ref) Value() interface{} {
+	return r
+}
+
+func (r *Ref) Copy() Value {
+	return r
+}
+
+func (r *Ref) Type() string {
+	return "ref"
+}
+
+func (r *Ref) Deref() Value {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.value
+}
+
+func (r *Ref) snapshot() (Value, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.value, r.version
+}
+
+// set replaces the value if the ref is still at version, and returns the
+// watches to notify.
+func (r *Ref) set(v Value, version int) (map[string]Value, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.version != version {
+		return nil, false
+	}
+	r.value = v
+	r.version++
+	watches := make(map[string]Value, len(r.watches))
+	for k, fn := range r.watches {
+		watches[k] = fn
+	}
+	return watches, true
+}
+
+func (r *Ref) notify(watches map[string]Value, old, v Value, c Context) Value {
+	keys := []string{}
+	for k := range watches {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		res := Apply(watches[k], []Value{Atom{t: "string", value: k}, r, old, v}, c)
+		if res.Type() == "error" {
+			return res
+		}
+	}
+	return v
+}
+
+func (r *Ref) Reset(v Value, c Context) Value {
+	for {
+		old, version := r.snapshot()
+		if watches, ok := r.set(v, version); ok {
+			return r.notify(watches, old, v, c)
+		}
+	}
+}
+
+// Swap sets the ref to the result of calling fn with its current value
+// followed by args.
+func (r *Ref) Swap(fn Value, args []Value, c Context) Value {
+	for {
+		old, version := r.snapshot()
+		v := Apply(fn, append([]Value{old}, args...), c)
+		if v.Type() == "error" {
+			return v
+		}
+		if watches, ok := r.set(v, version); ok {
+			return r.notify(watches, old, v, c)
+		}
+	}
+}
+
+// CompareAndSet sets the ref to v only if its current value is identical to
+// expected: equal for atoms, the same object for anything else.
+func (r *Ref) CompareAndSet(expected, v Value, c Context) bool {
+	old, version := r.snapshot()
+	if !identical(old, expected) {
+		return false
+	}
+	watches, ok := r.set(v, version)
+	if ok {
+		r.notify(watches, old, v, c)
+	}
+	return ok
+}
+
+func identical(a, b Value) bool {
+	if _, ok := a.(Atom); ok {
+		return Compare(a, b)
+	}
+	if reflect.TypeOf(a) != reflect.TypeOf(b) || reflect.TypeOf(a).Kind() != reflect.Ptr {
+		return false
+	}
+	return a == b
+}
+
+func refFunction(input *List, c Context) Value {
+	return NewRef(input.children[0])
+}
+
+func derefFunction(input *List, c Context) Value {
+	if f, ok := input.children[0].(*Future); ok {
+		return f.Await()
+	}
+	return input.children[0].(*Ref).Deref()
+}
+
+func resetBangFunction(input *List, c Context) Value {
+	return input.children[0].(*Ref).Reset(input.children[1], c)
+}
+
+func swapBangFunction(input *List, c Context) Value {
+	return input.children[0].(*Ref).Swap(input.children[1], input.children[2:], c)
+}
+
+func compareAndSetBangFunction(input *List, c Context) Value {
+	r := input.children[0].(*Ref)
+	return Atom{t: "bool", value: r.CompareAndSet(input.children[1], input.children[2], c)}
+}
+
+func addWatchBangFunction(input *List, c Context) Value {
+	r := input.children[0].(*Ref)
+	r.mu.Lock()
+	r.watches[input.children[1].Value().(string)] = input.children[2]
+	r.mu.Unlock()
+	return r
+}
+
+func removeWatchBangFunction(input *List, c Context) Value {
+	r := input.children[0].(*Ref)
+	r.mu.Lock()
+	delete(r.watches, input.children[1].Value().(string))
+	r.mu.Unlock()
+	return r
+}
@@ -0,0 +1,64 @@
+package sigmo
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRefs(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `
+(def r (ref 1))
+(def l '(1 2))
+(def lr (ref l))
+(def seen (ref '()))
+(def log-change (lambda (k r old new) (swap! seen (lambda (s) (cons (cat k ":" (string old) ">" (string new)) s)))))`)
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(deref r)`, "1"},
+		{`(swap! r + 2)`, "3"},
+		{`(reset! r 10)`, "10"},
+		{`(compare-and-set! r 10 11)`, "true"},
+		{`(compare-and-set! r 10 12)`, "false"},
+		{`(deref r)`, "11"},
+		{`(compare-and-set! lr '(1 2) '())`, "false"},
+		{`(compare-and-set! lr l '())`, "true"},
+		{`(do (add-watch! r "w" log-change) (swap! r + 1) (reset! r 0) (deref seen))`, `("w:12>0" "w:11>12")`},
+		{`(do (remove-watch! r "w") (reset! r 5) (len (deref seen)))`, "2"},
+	} {
+		if got := evalString(t, c, tc.src); got.String() != tc.want {
+			t.Errorf("%s = %s, want %s", tc.src, got, tc.want)
+		}
+	}
+	if got := evalError(t, c, `(swap! r cat "a")`); !strings.Contains(got, "cat") {
+		t.Errorf(`(swap! r cat "a"): got error %q`, got)
+	}
+	if got := c.Get("r").String(); got != "#<ref 5>" {
+		t.Errorf("failed swap! changed the ref to %s", got)
+	}
+}
+
+// TestSwapAtomic increments a ref from many goroutines, and is meant to be
+// run with -race.
+func TestSwapAtomic(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `(def counter (ref 0))`)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inner := NewContext(c)
+			for j := 0; j < 50; j++ {
+				evalString(t, inner, `(swap! counter + 1)`)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := evalString(t, c, `(deref counter)`).String(); got != "400" {
+		t.Errorf("counter = %s, want 400", got)
+	}
+}
@@ -2,74 +2,349 @@ package sigmo
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
-
-	"github.com/bobappleyard/readline"
+	"time"
 )
 
+// The prompts shown by REPL. They are colored when writing to a terminal,
+// unless the NO_COLOR environment variable is set.
 var (
-	mainPrompt       = "> "
-	incompletePrompt = ". "
+	MainPrompt       = "> "
+	IncompletePrompt = ". "
 )
 
-func REPL(c Context) (Context, error) {
-	tokens := []string{}
-	leftCount := 0
-	rightCount := 0
+type replCommand struct {
+	args string
+	help string
+	// run returns false to end the session
+	run func(s *session, arg string) bool
+}
+
+var replCommands map[string]replCommand
+
+// session is the state of a REPL: the context input is evaluated in, which
+// changes with ':ns', and what has been entered and loaded so far.
+type session struct {
+	root   Context
+	c      Context
+	ns     string
+	editor *lineEditor
+	inputs []string
+	loaded []loadedFile
+}
 
+// loadedFile is a file loaded with ':load', and the namespace it was loaded
+// into, which ':reload' loads it into again.
+type loadedFile struct {
+	file string
+	c    Context
+}
+
+func historyFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".sigmo_history")
+}
+
+// REPL reads and evaluates input until ':quit', 'quit' or Ctrl-D. Input is
+// read until every list, hash and string in it is closed, and Ctrl-C
+// discards it. Lines starting with a known ':command' are run as REPL
+// commands, see ':help'.
+func REPL(c Context) (Context, error) {
+	s := &session{root: c, c: c, editor: newLineEditor(historyFile())}
+	s.editor.complete = func(head string) (string, []string) {
+		return completer(s.c)(head)
+	}
+	for _, name := range []string{"*1", "*2", "*e"} {
+		c.Set(name, NIL)
+	}
+	src := ""
 	for {
-		prompt := mainPrompt
-		if len(tokens) > 0 {
-			prompt = incompletePrompt
+		prompt := s.editor.color(s.ns+MainPrompt, "32")
+		if src != "" {
+			prompt = s.editor.color(IncompletePrompt, "90")
 		}
 
-		line, err := readline.String(prompt)
+		line, err := s.editor.ReadLine(prompt)
+		if err == errInterrupt {
+			src = ""
+			continue
+		}
+		if err == io.EOF {
+			return c, nil
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		if line != "" {
-			line = strings.TrimRight(line, "\r\n ")
-			readline.AddHistory(line)
+		if src == "" && strings.TrimSpace(line) == "quit" {
+			return c, nil
+		}
+		src += line + "\n"
+		if Incomplete(src) {
+			continue
+		}
+		s.editor.AddHistory(src)
+		input := strings.TrimSpace(src)
+		src = ""
 
-			if line == "quit" {
+		if name, arg, ok := command(input); ok {
+			if !replCommands[name].run(s, arg) {
 				return c, nil
 			}
+			continue
+		}
+		if r := s.run(input); r.Type() != "error" && input != "" {
+			s.inputs = append(s.inputs, input)
+		}
+	}
+}
 
-			temp := Tokenize(line)
-			for _, t := range temp {
-				if t == "(" || t == "'(" {
-					leftCount += 1
-				} else if t == ")" {
-					rightCount += 1
-				}
-			}
+// command splits input into a REPL command name and its argument.
+func command(input string) (string, string, bool) {
+	if !strings.HasPrefix(input, ":") {
+		return "", "", false
+	}
+	fields := strings.SplitN(input, " ", 2)
+	if _, ok := replCommands[fields[0][1:]]; !ok {
+		return "", "", false
+	}
+	if len(fields) == 1 {
+		return fields[0][1:], "", true
+	}
+	return fields[0][1:], strings.TrimSpace(fields[1]), true
+}
 
-			tokens = append(tokens, temp...)
-
-			if leftCount == rightCount {
-				nodes, err := Parse(tokens)
-				if err != nil {
-					fmt.Println("error: ", err)
-				} else {
-					for _, n := range nodes {
-						r := n.Eval(c)
-
-						if r.Type() == "error" {
-							fmt.Println("error:", r.Value().(string))
-							break
-						}
-
-						if r != NIL {
-							fmt.Println(r)
-						}
-					}
-				}
-
-				leftCount = 0
-				rightCount = 0
-				tokens = []string{}
-			}
+// eval evaluates src, returning the value of its last form.
+func (s *session) eval(src string) Value {
+	nodes, err := ParseFile("<repl>", src)
+	if err != nil {
+		return Atom{t: "error", value: err.Error()}
+	}
+	var last Value = NIL
+	for _, n := range nodes {
+		last = n.Eval(s.c)
+		if last.Type() == "error" {
+			return last
+		}
+	}
+	return last
+}
+
+// run evaluates src, printing each result and binding it to '*1', or the
+// error it stops at to '*e'.
+func (s *session) run(src string) Value {
+	nodes, err := ParseFile("<repl>", src)
+	if err != nil {
+		s.error(err)
+		return Atom{t: "error", value: err.Error()}
+	}
+	var last Value = NIL
+	for _, n := range nodes {
+		last = n.Eval(s.c)
+
+		if last.Type() == "error" {
+			s.root.Set("*e", last)
+			s.error(last.Value())
+			break
+		}
+		s.root.Set("*2", s.root.Get("*1"))
+		s.root.Set("*1", last)
+
+		if last != NIL {
+			fmt.Println(last)
+		}
+	}
+	return last
+}
+
+func (s *session) error(err interface{}) {
+	fmt.Println(s.editor.color("error:", "31"), err)
+}
+
+func (s *session) load(file string, c Context) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		s.error(err)
+		return
+	}
+	nodes, err := ParseFile(file, string(data))
+	if err != nil {
+		s.error(err)
+		return
+	}
+	for _, n := range nodes {
+		if r := n.Eval(c); r.Type() == "error" {
+			s.error(r.Value())
+			return
+		}
+	}
+	for i, f := range s.loaded {
+		if f.file == file {
+			s.loaded[i].c = c
+			return
 		}
 	}
+	s.loaded = append(s.loaded, loadedFile{file: file, c: c})
+}
+
+func docCommand(s *session, arg string) bool {
+	if arg == "" {
+		s.error("usage: :doc name")
+		return true
+	}
+	fmt.Println(docFunction(&List{children: []Value{Atom{t: "string", value: arg}}}, s.c).Value())
+	return true
+}
+
+func typeCommand(s *session, arg string) bool {
+	v := s.eval(arg)
+	if v.Type() == "error" {
+		s.error(v.Value())
+		return true
+	}
+	fmt.Println(Atom{t: "type", value: v.Type()})
+	return true
+}
+
+func timeCommand(s *session, arg string) bool {
+	start := time.Now()
+	s.run(arg)
+	fmt.Printf("Elapsed time: %s\n", time.Since(start))
+	return true
+}
+
+func envCommand(s *session, arg string) bool {
+	for _, name := range s.c.Names() {
+		if _, ok := builtins[name]; ok {
+			continue
+		}
+		if _, ok := aliases[name]; ok || name == "*1" || name == "*2" || name == "*e" {
+			continue
+		}
+		if strings.HasPrefix(name, arg) {
+			fmt.Printf("%s %s\n", name, Atom{t: "type", value: s.c.Get(name).Type()})
+		}
+	}
+	return true
+}
+
+func nsCommand(s *session, arg string) bool {
+	if arg == "" || arg == "/" {
+		s.c, s.ns = s.root, ""
+		return true
+	}
+	ns := lookupNamespace(s.root, arg)
+	if ns == nil {
+		s.error(fmt.Sprintf("Unknown namespace '%s'", arg))
+		return true
+	}
+	s.c, s.ns = ns, arg
+	return true
+}
+
+func loadCommand(s *session, arg string) bool {
+	if arg == "" {
+		s.error("usage: :load file")
+		return true
+	}
+	s.load(arg, s.c)
+	return true
+}
+
+func reloadCommand(s *session, arg string) bool {
+	if len(s.loaded) == 0 {
+		s.error("no files have been loaded")
+		return true
+	}
+	for _, f := range s.loaded {
+		s.load(f.file, f.c)
+	}
+	return true
+}
+
+func saveCommand(s *session, arg string) bool {
+	if arg == "" {
+		s.error("usage: :save file")
+		return true
+	}
+	out := strings.Join(s.inputs, "\n")
+	if out != "" {
+		out += "\n"
+	}
+	if err := ioutil.WriteFile(arg, []byte(out), 0644); err != nil {
+		s.error(err)
+		return true
+	}
+	fmt.Printf("Saved %d inputs to %s\n", len(s.inputs), arg)
+	return true
+}
+
+// macroexpandCommand prints what a macro call expands to, expanding again
+// for as long as the result is a single macro call.
+func macroexpandCommand(s *session, arg string) bool {
+	nodes, err := ParseFile("<repl>", arg)
+	if err != nil {
+		s.error(err)
+		return true
+	}
+	if len(nodes) != 1 {
+		s.error("usage: :macroexpand (macro args...)")
+		return true
+	}
+	forms := nodes
+	for len(forms) == 1 {
+		l, ok := forms[0].(*List)
+		if !ok || len(l.children) == 0 || l.children[0].Type() != "identifier" {
+			break
+		}
+		m, ok := s.c.Get(l.children[0].Value().(string)).(Macro)
+		if !ok {
+			break
+		}
+		if forms, err = m.Expand(l); err != nil {
+			s.error(err)
+			return true
+		}
+	}
+	for _, f := range forms {
+		fmt.Println(f)
+	}
+	return true
+}
+
+func helpCommand(s *session, arg string) bool {
+	names := []string{}
+	for name := range replCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := replCommands[name]
+		fmt.Printf("  %-26s %s\n", strings.TrimSpace(":"+name+" "+cmd.args), cmd.help)
+	}
+	return true
+}
+
+func init() {
+	replCommands = map[string]replCommand{
+		"doc":         {"name", "show the documentation for name", docCommand},
+		"type":        {"expr", "show the type of the value of expr", typeCommand},
+		"time":        {"expr", "evaluate expr and show how long it took", timeCommand},
+		"env":         {"[prefix]", "list the bindings in scope, other than builtins", envCommand},
+		"ns":          {"[name]", "evaluate in namespace name, or the top level", nsCommand},
+		"load":        {"file", "evaluate a file in the current namespace", loadCommand},
+		"reload":      {"", "load every loaded file again", reloadCommand},
+		"save":        {"file", "write the inputs entered so far to file", saveCommand},
+		"macroexpand": {"form", "show what a macro call expands to", macroexpandCommand},
+		"help":        {"", "list the REPL commands", helpCommand},
+		"quit":        {"", "end the session", func(s *session, arg string) bool { return false }},
+	}
 }
@@ -0,0 +1,354 @@
+package sigmo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Iterator yields the next element of a sequence, and false once it is
+// exhausted.
+type Iterator func() (Value, bool)
+
+// Iterable values can be consumed one element at a time by 'for', 'len' and
+// the seq builtins.
+type Iterable interface {
+	Iter() Iterator
+}
+
+// Seq is a lazy sequence. Elements are only computed as they are consumed,
+// and each call to Iter starts again from the beginning, so a Seq may be
+// infinite as long as it is only partially consumed. Seqs known to be
+// infinite, such as (range) or (iterate f x), are marked so that consuming
+// them whole is an error rather than a hang, but others may never end too.
+type Seq struct {
+	gen      func() Iterator
+	infinite bool
+}
+
+func NewSeq(gen func() Iterator) *Seq {
+	return &Seq{gen: gen}
+}
+
+func (s *Seq) String() string {
+	return unreadable("seq", "")
+}
+
+func (s *Seq) Eval(c Context) Value {
+	return s
+}
+
+func (s *Seq) Value() interface{} {
+	return NIL
+}
+
+func (s *Seq) Copy() Value {
+	return s
+}
+
+func (s *Seq) Type() string {
+	return "seq"
+}
+
+func (s *Seq) Iter() Iterator {
+	return s.gen()
+}
+
+// isInfinite reports whether v is a seq known to never end.
+func isInfinite(v Value) bool {
+	s, ok := v.(*Seq)
+	return ok && s.infinite
+}
+
+// infiniteError is the error for consuming a whole seq that never ends.
+func infiniteError(name string) Value {
+	return Atom{t: "error", value: fmt.Sprintf("Function '%s' cannot consume an infinite seq.", name)}
+}
+
+func (s *Seq) Length() Atom {
+	n := 0
+	next := s.Iter()
+	for _, ok := next(); ok; _, ok = next() {
+		n++
+	}
+	return Atom{t: "int", value: n}
+}
+
+func isNumber(v Value) bool {
+	return v.Type() == "int" || v.Type() == "float"
+}
+
+func rangeFunction(input *List, c Context) Value {
+	start, step := Atom{t: "int", value: 0}, Atom{t: "int", value: 1}
+	var end Value = NIL
+	for _, a := range input.children {
+		if !isNumber(a) {
+			return Atom{t: "error", value: fmt.Sprintf("Function 'range' cannot have '%s' as argtype, expected 'int|float'.", a.Type())}
+		}
+	}
+	switch len(input.children) {
+	case 0:
+	case 1:
+		end = input.children[0]
+	case 3:
+		step = input.children[2].(Atom)
+		fallthrough
+	case 2:
+		start, end = input.children[0].(Atom), input.children[1]
+	default:
+		return Atom{t: "error", value: fmt.Sprintf("Function 'range' expected at most 3 args, got %d.", len(input.children))}
+	}
+	dir := CompareNum(step, Atom{t: "int", value: 0})
+	if dir == 0 {
+		return Atom{t: "error", value: "Function 'range' cannot have a step of zero."}
+	}
+	s := NewSeq(func() Iterator {
+		x := start
+		return func() (Value, bool) {
+			if end != NIL && CompareNum(x, end.(Atom)) != -dir {
+				return nil, false
+			}
+			v := x
+			x = Add(x, step)
+			return v, true
+		}
+	})
+	s.infinite = end == NIL
+	return s
+}
+
+func iterateFunction(input *List, c Context) Value {
+	fn, init := input.children[0], input.children[1]
+	s := NewSeq(func() Iterator {
+		var x Value
+		return func() (Value, bool) {
+			if x == nil {
+				x = init
+			} else if x.Type() == "error" {
+				return nil, false
+			} else {
+				x = Apply(fn, []Value{x}, c)
+			}
+			return x, true
+		}
+	})
+	s.infinite = true
+	return s
+}
+
+func repeatFunction(input *List, c Context) Value {
+	x, n := input.children[0], -1
+	if len(input.children) > 1 {
+		if input.children[0].Type() != "int" {
+			return Atom{t: "error", value: fmt.Sprintf("Function 'repeat' cannot have '%s' as argtype, expected 'int'.", input.children[0].Type())}
+		}
+		x, n = input.children[1], input.children[0].Value().(int)
+	}
+	s := NewSeq(func() Iterator {
+		i := 0
+		return func() (Value, bool) {
+			if n >= 0 && i >= n {
+				return nil, false
+			}
+			i++
+			return x, true
+		}
+	})
+	s.infinite = n < 0
+	return s
+}
+
+func cycleFunction(input *List, c Context) Value {
+	coll := input.children[0].(Iterable)
+	s := NewSeq(func() Iterator {
+		next := coll.Iter()
+		empty := true
+		return func() (Value, bool) {
+			v, ok := next()
+			if !ok {
+				if empty {
+					return nil, false
+				}
+				next = coll.Iter()
+				v, ok = next()
+			}
+			empty = false
+			return v, ok
+		}
+	})
+	l, ok := coll.(*List)
+	s.infinite = isInfinite(input.children[0]) || ok && len(l.children) > 0
+	return s
+}
+
+func takeFunction(input *List, c Context) Value {
+	n, coll := input.children[0].Value().(int), input.children[1].(Iterable)
+	return NewSeq(func() Iterator {
+		next := coll.Iter()
+		i := 0
+		return func() (Value, bool) {
+			if i >= n {
+				return nil, false
+			}
+			i++
+			return next()
+		}
+	})
+}
+
+func dropFunction(input *List, c Context) Value {
+	n, coll := input.children[0].Value().(int), input.children[1].(Iterable)
+	s := NewSeq(func() Iterator {
+		next := coll.Iter()
+		for i := 0; i < n; i++ {
+			if _, ok := next(); !ok {
+				break
+			}
+		}
+		return next
+	})
+	s.infinite = isInfinite(input.children[1])
+	return s
+}
+
+func takeWhileFunction(input *List, c Context) Value {
+	fn, coll := input.children[0], input.children[1].(Iterable)
+	return NewSeq(func() Iterator {
+		next := coll.Iter()
+		done := false
+		return func() (Value, bool) {
+			if done {
+				return nil, false
+			}
+			v, ok := next()
+			if !ok {
+				return nil, false
+			}
+			r := Apply(fn, []Value{v}, c)
+			if r.Type() == "error" {
+				done = true
+				return r, true
+			}
+			if !Boolean(r) {
+				done = true
+				return nil, false
+			}
+			return v, true
+		}
+	})
+}
+
+func lazyMapFunction(input *List, c Context) Value {
+	fn, coll := input.children[0], input.children[1].(Iterable)
+	s := NewSeq(func() Iterator {
+		next := coll.Iter()
+		return func() (Value, bool) {
+			v, ok := next()
+			if !ok {
+				return nil, false
+			}
+			return Apply(fn, []Value{v}, c), true
+		}
+	})
+	s.infinite = isInfinite(input.children[1])
+	return s
+}
+
+func lazyFilterFunction(input *List, c Context) Value {
+	fn, coll := input.children[0], input.children[1].(Iterable)
+	s := NewSeq(func() Iterator {
+		next := coll.Iter()
+		return func() (Value, bool) {
+			for v, ok := next(); ok; v, ok = next() {
+				r := Apply(fn, []Value{v}, c)
+				if r.Type() == "error" {
+					return r, true
+				}
+				if Boolean(r) {
+					return v, true
+				}
+			}
+			return nil, false
+		}
+	})
+	// a filter of an infinite seq either never ends or hangs looking
+	s.infinite = isInfinite(input.children[1])
+	return s
+}
+
+func collectFunction(input *List, c Context) Value {
+	if isInfinite(input.children[0]) {
+		return infiniteError("collect")
+	}
+	out := &List{}
+	next := input.children[0].(Iterable).Iter()
+	for v, ok := next(); ok; v, ok = next() {
+		if v.Type() == "error" {
+			return v
+		}
+		out.children = append(out.children, v)
+	}
+	return out
+}
+
+// readLinesChunk is how many lines read-lines reads each time it opens the
+// file. It is closed again in between, so a seq that is never finished, as
+// with (take 3 (read-lines f)), doesn't leave it open.
+const readLinesChunk = 512
+
+func readLinesFunction(input *List, c Context) Value {
+	fname := input.children[0].Value().(string)
+	return NewSeq(func() Iterator {
+		var offset int64
+		var lines []string
+		done := false
+		return func() (Value, bool) {
+			if len(lines) == 0 && !done {
+				var err error
+				lines, offset, err = readLines(fname, offset, readLinesChunk)
+				if err != nil {
+					done = true
+					return Atom{t: "error", value: fmt.Sprintf("Could not read lines of '%s': %v", fname, err)}, true
+				}
+				done = len(lines) < readLinesChunk
+			}
+			if len(lines) == 0 {
+				return nil, false
+			}
+			line := lines[0]
+			lines = lines[1:]
+			return Atom{t: "string", value: line}, true
+		}
+	})
+}
+
+// readLines reads up to n lines of a file from offset, without their line
+// endings, and returns the offset after them.
+func readLines(fname string, offset int64, n int) ([]string, int64, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, offset, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+	r := bufio.NewReader(f)
+	lines := []string{}
+	for len(lines) < n {
+		line, err := r.ReadString('\n')
+		offset += int64(len(line))
+		if line != "" {
+			lines = append(lines, strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, offset, err
+		}
+	}
+	return lines, offset, nil
+}
@@ -0,0 +1,52 @@
+package sigmo
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestSeqLaziness checks seqs are only computed as far as they are consumed.
+func TestSeqLaziness(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `
+(def calls (ref 0))
+(def s (iterate (lambda (x) (do (swap! calls + 1) (+ x 1))) 0))`)
+	for _, tc := range []struct {
+		src   string
+		want  string
+		calls int
+	}{
+		{`(if s "true" "false")`, `"true"`, 0},
+		{`(collect (take 3 s))`, "(0 1 2)", 2},
+		{`(collect (take 2 (lazy-map (lambda (x) (* x 10)) s)))`, "(0 10)", 3},
+		{`(find (lambda (x) (> x 4)) s)`, "5", 8},
+		{`(if (take 0 (range)) 1 2)`, "1", 8},
+		{`(if (read-lines "no/such/file") 1 2)`, "1", 8},
+		{`(collect (take 3 (drop 2 (cycle '(1 2 3)))))`, "(3 1 2)", 8},
+		{`(collect (take-while (lambda (x) (< x 3)) (range)))`, "(0 1 2)", 8},
+		{`(len (repeat 3 :a))`, "3", 8},
+	} {
+		if got := evalString(t, c, tc.src).String(); got != tc.want {
+			t.Errorf("%s = %s, want %s", tc.src, got, tc.want)
+		}
+		if n := c.Get("calls").(*Ref).Deref().Value().(int); n != tc.calls {
+			t.Errorf("after %s, iterate called its function %d times, want %d", tc.src, n, tc.calls)
+		}
+	}
+}
+
+func TestInfiniteSeqs(t *testing.T) {
+	c := NewContext(nil)
+	for _, src := range []string{
+		`(len (range))`,
+		`(collect (iterate (lambda (x) x) 1))`,
+		`(map + (repeat 1))`,
+		`(sort (lazy-map (lambda (x) x) (cycle '(1))))`,
+		`(len (drop 5 (range)))`,
+	} {
+		got := evalError(t, c, src)
+		if !strings.Contains(got, "cannot consume an infinite seq") {
+			t.Errorf("%s: got error %q", src, got)
+		}
+	}
+}
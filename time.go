@@ -0,0 +1,248 @@
+package sigmo
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type Time struct {
+	t time.Time
+}
+
+func (t *Time) String() string {
+	return unreadable("time", t.t.Format(time.RFC3339Nano))
+}
+
+func (t *Time) Eval(c Context) Value {
+	return t
+}
+
+func (t *Time) Value() interface{} {
+	return t.t
+}
+
+func (t *Time) Copy() Value {
+	return t
+}
+
+func (t *Time) Type() string {
+	return "time"
+}
+
+type Duration struct {
+	d time.Duration
+}
+
+func (d *Duration) String() string {
+	return unreadable("duration", d.d.String())
+}
+
+func (d *Duration) Eval(c Context) Value {
+	return d
+}
+
+func (d *Duration) Value() interface{} {
+	return d.d
+}
+
+func (d *Duration) Copy() Value {
+	return d
+}
+
+func (d *Duration) Type() string {
+	return "duration"
+}
+
+var timeLayouts = map[string]string{
+	"ANSIC":    time.ANSIC,
+	"RFC822":   time.RFC822,
+	"RFC1123":  time.RFC1123,
+	"RFC3339":  time.RFC3339,
+	"Kitchen":  time.Kitchen,
+	"Stamp":    time.Stamp,
+	"DateTime": "2006-01-02 15:04:05",
+	"DateOnly": "2006-01-02",
+	"TimeOnly": "15:04:05",
+}
+
+func layout(s string) string {
+	if l, ok := timeLayouts[s]; ok {
+		return l
+	}
+	return s
+}
+
+// toDuration treats plain numbers as milliseconds.
+func toDuration(v Value) time.Duration {
+	switch v.Type() {
+	case "duration":
+		return v.(*Duration).d
+	case "float":
+		return time.Duration(v.Value().(float64) * float64(time.Millisecond))
+	}
+	return time.Duration(v.Value().(int)) * time.Millisecond
+}
+
+func nowFunction(input *List, c Context) Value {
+	if len(input.children) > 0 {
+		return Atom{t: "error", value: fmt.Sprintf("Function 'time/now' expected 0 args, got %d.", len(input.children))}
+	}
+	return &Time{time.Now()}
+}
+
+func sleepFunction(input *List, c Context) Value {
+	time.Sleep(toDuration(input.children[0]))
+	return NIL
+}
+
+func sinceFunction(input *List, c Context) Value {
+	return &Duration{time.Since(input.children[0].(*Time).t)}
+}
+
+func durationFunction(input *List, c Context) Value {
+	if input.children[0].Type() != "string" {
+		return &Duration{toDuration(input.children[0])}
+	}
+	d, err := time.ParseDuration(input.children[0].Value().(string))
+	if err != nil {
+		return Atom{t: "error", value: err.Error()}
+	}
+	return &Duration{d}
+}
+
+func secondsFunction(input *List, c Context) Value {
+	return Atom{t: "float", value: input.children[0].(*Duration).d.Seconds()}
+}
+
+func millisFunction(input *List, c Context) Value {
+	return Atom{t: "int", value: int(input.children[0].(*Duration).d / time.Millisecond)}
+}
+
+func timeAddFunction(input *List, c Context) Value {
+	d := input.children[1].(*Duration).d
+	if t, ok := input.children[0].(*Time); ok {
+		return &Time{t.t.Add(d)}
+	}
+	return &Duration{input.children[0].(*Duration).d + d}
+}
+
+func timeSubFunction(input *List, c Context) Value {
+	a, b := input.children[0], input.children[1]
+	switch {
+	case a.Type() == "time" && b.Type() == "time":
+		return &Duration{a.(*Time).t.Sub(b.(*Time).t)}
+	case a.Type() == "time":
+		return &Time{a.(*Time).t.Add(-b.(*Duration).d)}
+	case b.Type() == "duration":
+		return &Duration{a.(*Duration).d - b.(*Duration).d}
+	}
+	return Atom{t: "error", value: "Cannot subtract a time from a duration"}
+}
+
+func beforeFunction(input *List, c Context) Value {
+	return Atom{t: "bool", value: input.children[0].(*Time).t.Before(input.children[1].(*Time).t)}
+}
+
+func afterFunction(input *List, c Context) Value {
+	return Atom{t: "bool", value: input.children[0].(*Time).t.After(input.children[1].(*Time).t)}
+}
+
+func formatFunction(input *List, c Context) Value {
+	return Atom{t: "string", value: input.children[0].(*Time).t.Format(layout(input.children[1].Value().(string)))}
+}
+
+func parseTimeFunction(input *List, c Context) Value {
+	t, err := time.Parse(layout(input.children[0].Value().(string)), input.children[1].Value().(string))
+	if err != nil {
+		return Atom{t: "error", value: err.Error()}
+	}
+	return &Time{t}
+}
+
+func inFunction(input *List, c Context) Value {
+	loc, err := time.LoadLocation(input.children[1].Value().(string))
+	if err != nil {
+		return Atom{t: "error", value: err.Error()}
+	}
+	return &Time{input.children[0].(*Time).t.In(loc)}
+}
+
+func utcFunction(input *List, c Context) Value {
+	return &Time{input.children[0].(*Time).t.UTC()}
+}
+
+func unixFunction(input *List, c Context) Value {
+	return Atom{t: "int", value: int(input.children[0].(*Time).t.Unix())}
+}
+
+func fromUnixFunction(input *List, c Context) Value {
+	if input.children[0].Type() == "float" {
+		s := input.children[0].Value().(float64)
+		return &Time{time.Unix(0, int64(s*float64(time.Second)))}
+	}
+	return &Time{time.Unix(int64(input.children[0].Value().(int)), 0)}
+}
+
+// timerFunction returns a channel that receives the time once the duration
+// has passed. Closing the channel cancels the timer.
+func timerFunction(input *List, c Context) Value {
+	ch := &Chan{ch: make(chan Value, 1)}
+	t := time.NewTimer(toDuration(input.children[0]))
+	ch.stop = forward(t.C, ch, func() { t.Stop() }, false)
+	return ch
+}
+
+// tickerFunction returns a channel that receives the time at every interval
+// until it is closed. Ticks are dropped if the receiver falls behind.
+func tickerFunction(input *List, c Context) Value {
+	d := toDuration(input.children[0])
+	if d <= 0 {
+		return Atom{t: "error", value: "Function 'time/ticker' needs a positive interval"}
+	}
+	ch := &Chan{ch: make(chan Value, 1)}
+	t := time.NewTicker(d)
+	ch.stop = forward(t.C, ch, t.Stop, true)
+	return ch
+}
+
+// forward copies times from src to ch, just once unless repeat is set, until
+// the returned stop function is called. stop waits for the copying to finish
+// so that ch can then be closed safely.
+func forward(src <-chan time.Time, ch *Chan, halt func(), repeat bool) func() {
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case now := <-src:
+				select {
+				case ch.ch <- &Time{now}:
+					if !repeat {
+						return
+					}
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			halt()
+			close(done)
+			<-exited
+		})
+	}
+}
+
+// timeItForm evaluates its body like 'do', printing how long it took.
+func timeItForm(form *List, c Context) Value {
+	start := time.Now()
+	v := doForm(form, c)
+	fmt.Printf("Elapsed time: %s\n", time.Since(start))
+	return v
+}
@@ -0,0 +1,67 @@
+package sigmo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTime(t *testing.T) {
+	c := NewContext(nil)
+	evalString(t, c, `(def t0 (time/parse "RFC3339" "2024-03-01T12:00:00Z"))`)
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(time/format t0 "DateTime")`, `"2024-03-01 12:00:00"`},
+		{`(time/unix t0)`, "1709294400"},
+		{`(time/format (time/from-unix 1709294400.5) "RFC3339")`, `"2024-03-01T12:00:00Z"`},
+		{`(time/format (time/add t0 (time/duration "36h")) "DateOnly")`, `"2024-03-03"`},
+		{`(time/seconds (time/sub (time/add t0 (time/duration 1500)) t0))`, "1.5"},
+		{`(time/millis (time/duration "2s"))`, "2000"},
+		{`(time/millis (time/sub (time/duration "2s") (time/duration 500)))`, "1500"},
+		{`(time/before? t0 (time/add t0 (time/duration 1)))`, "true"},
+		{`(time/after? t0 (time/add t0 (time/duration 1)))`, "false"},
+		{`(time/format (time/in t0 "UTC") "Kitchen")`, `"12:00PM"`},
+		{`(time/duration "1m30s")`, "#<duration 1m30s>"},
+		{`(time/sleep 1)`, "nil"},
+		{`(sleep 1)`, "nil"},
+	} {
+		if got := evalString(t, c, tc.src).String(); got != tc.want {
+			t.Errorf("%s = %s, want %s", tc.src, got, tc.want)
+		}
+	}
+	if got := evalString(t, c, `(time/seconds (time/since (time/now)))`).Value().(float64); got < 0 {
+		t.Errorf("time/since returned a negative duration, %v", got)
+	}
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(time/sub (time/duration 1) t0)`, "Cannot subtract a time from a duration"},
+		{`(time/parse "DateOnly" "March")`, "cannot parse"},
+		{`(time/ticker 0)`, "needs a positive interval"},
+		{`(time/now 1)`, "Function 'time/now' expected 0 args, got 1."},
+	} {
+		if got := evalError(t, c, tc.src); !strings.Contains(got, tc.want) {
+			t.Errorf("%s: got error %q, want %q", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestTimers(t *testing.T) {
+	c := NewContext(nil)
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{`(type (recv (time/timer 1)))`, "#time"},
+		{`(select (recv (time/timer 5000) v :fired) (recv (time/timer 1) v :first))`, ":first"},
+		{`(do (def tk (time/ticker 1)) (recv tk) (recv tk) (close! tk) (recv tk))`, "nil"},
+		{`(do (def tm (time/timer 5000)) (close! tm) (recv tm))`, "nil"},
+		{`(time-it (+ 1 2))`, "3"},
+	} {
+		if got := evalString(t, c, tc.src).String(); got != tc.want {
+			t.Errorf("%s = %s, want %s", tc.src, got, tc.want)
+		}
+	}
+}
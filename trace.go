@@ -0,0 +1,170 @@
+package sigmo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// TraceOutput is where calls to traced functions, and the forms a Tracer
+// logs, are written.
+var TraceOutput io.Writer = os.Stderr
+
+// traceDepth is how many calls to traced functions are in progress, which
+// their output is indented by.
+var traceDepth int32
+
+func traceIndent(depth int) string {
+	return strings.Repeat("| ", depth)
+}
+
+func traceResult(v Value) string {
+	if v.Type() == "error" {
+		return fmt.Sprintf("error: %v", v.Value())
+	}
+	return v.String()
+}
+
+// traced holds the names functions were traced by, keyed by traceKey, so
+// that Function.Call traces every copy of them, including those closures
+// captured before the trace began. tracedCount lets calls skip the lookup
+// while nothing is traced.
+var (
+	tracedMu    sync.RWMutex
+	traced      = make(map[traceKey]string)
+	tracedCount int32
+)
+
+// traceKey identifies a function across copies: a lambda by its source
+// and the bindings it closes over, and a builtin by its name.
+type traceKey struct {
+	source *List
+	env    uintptr
+	name   string
+}
+
+func traceKeyOf(f Function) traceKey {
+	if f.source == nil {
+		return traceKey{name: f.name}
+	}
+	return traceKey{source: f.source, env: reflect.ValueOf(f.env).Pointer()}
+}
+
+// tracedName returns the name f was traced by, if it is traced.
+func tracedName(f Function) (string, bool) {
+	if atomic.LoadInt32(&tracedCount) == 0 {
+		return "", false
+	}
+	tracedMu.RLock()
+	defer tracedMu.RUnlock()
+	name, ok := traced[traceKeyOf(f)]
+	return name, ok
+}
+
+// traceCall calls f, printing its arguments and then what it returns.
+func traceCall(name string, f Function, args *List, c Context) Value {
+	depth := int(atomic.AddInt32(&traceDepth, 1)) - 1
+	defer atomic.AddInt32(&traceDepth, -1)
+	call := &List{children: append([]Value{Atom{t: "identifier", value: name}}, args.children...)}
+	fmt.Fprintf(TraceOutput, "%s%s\n", traceIndent(depth), call)
+	v := f.fn(args, c)
+	fmt.Fprintf(TraceOutput, "%s=> %s\n", traceIndent(depth), traceResult(v))
+	return v
+}
+
+// tracedFunctions looks up each of the functions named in form.
+func tracedFunctions(form *List, c Context) ([]Function, Value) {
+	fns := []Function{}
+	for _, a := range form.children[1:] {
+		if a.Type() != "identifier" {
+			return nil, Atom{t: "error", value: fmt.Sprintf("%s expected arguments of type 'identifier', got type '%s'", form.children[0], a.Type())}
+		}
+		v := c.Get(a.Value().(string))
+		if v.Type() == "error" {
+			return nil, v
+		}
+		f, ok := v.(Function)
+		if !ok {
+			return nil, Atom{t: "error", value: fmt.Sprintf("Cannot %s value of type '%s'", form.children[0], v.Type())}
+		}
+		fns = append(fns, f)
+	}
+	return fns, nil
+}
+
+// traceForm marks each of the named functions so that their calls and
+// returns are printed, wherever they are called from, until they are
+// untraced.
+func traceForm(form *List, c Context) Value {
+	fns, err := tracedFunctions(form, c)
+	if err != nil {
+		return err
+	}
+	tracedMu.Lock()
+	defer tracedMu.Unlock()
+	for i, f := range fns {
+		k := traceKeyOf(f)
+		if _, ok := traced[k]; !ok {
+			traced[k] = form.children[i+1].Value().(string)
+			atomic.AddInt32(&tracedCount, 1)
+		}
+	}
+	return NIL
+}
+
+func untraceForm(form *List, c Context) Value {
+	fns, err := tracedFunctions(form, c)
+	if err != nil {
+		return err
+	}
+	tracedMu.Lock()
+	defer tracedMu.Unlock()
+	for _, f := range fns {
+		k := traceKeyOf(f)
+		if _, ok := traced[k]; ok {
+			delete(traced, k)
+			atomic.AddInt32(&tracedCount, -1)
+		}
+	}
+	return NIL
+}
+
+// Tracer is a DebugHook logging every list evaluated, whether a special
+// form or a function application, followed by its result. Lines are
+// indented by how deeply the lists are nested, and those nested deeper than
+// the limit are left out.
+type Tracer struct {
+	mu    sync.Mutex
+	w     io.Writer
+	limit int
+	depth int
+}
+
+// NewTracer returns a Tracer writing to w, leaving out lists nested more
+// than limit deep, unless limit is 0.
+func NewTracer(w io.Writer, limit int) *Tracer {
+	return &Tracer{w: w, limit: limit}
+}
+
+func (t *Tracer) Enter(form *List, c Context) Value {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.limit <= 0 || t.depth < t.limit {
+		fmt.Fprintf(t.w, "%s%s\n", traceIndent(t.depth), clip(form.String(), 100))
+	}
+	t.depth++
+	return nil
+}
+
+func (t *Tracer) Leave(form *List, c Context, result Value) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.depth--
+	if t.limit <= 0 || t.depth < t.limit {
+		fmt.Fprintf(t.w, "%s=> %s\n", traceIndent(t.depth), clip(traceResult(result), 100))
+	}
+}
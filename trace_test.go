@@ -0,0 +1,30 @@
+package sigmo
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestTraceCapturedFunction traces a function that another closure captured
+// before the trace began.
+func TestTraceCapturedFunction(t *testing.T) {
+	var buf bytes.Buffer
+	out := TraceOutput
+	TraceOutput = &buf
+	defer func() { TraceOutput = out }()
+
+	c := NewContext(nil)
+	evalString(t, c, `
+(def run (lambda ()
+  (do
+    (def f (lambda (x) (* x 2)))
+    (def g (lambda (x) (+ 1 (f x))))
+    (trace f)
+    (g 3)
+    (untrace f)
+    (g 4))))
+(run)`)
+	if want := "(f 3)\n=> 6\n"; buf.String() != want {
+		t.Errorf("traced %q, want %q", buf.String(), want)
+	}
+}
@@ -84,10 +84,15 @@ func Boolean(n Value) bool {
 		return len(n.(*List).children) > 0
 	}
 	if n.Type() == "hash" {
-		h := n.(*Hash)
-		return len(h.vals)+len(h.sym_vals) > 0
+		return n.(*Hash).Length().Value().(int) > 0
+	}
+	if t, ok := n.(*Tagged); ok {
+		return Boolean(t.value)
+	}
+	a, ok := n.(Atom)
+	if !ok {
+		return true
 	}
-	a := n.(Atom)
 	switch a.t {
 	case "string":
 		return len(a.value.(string)) > 0
@@ -104,7 +109,38 @@ func Boolean(n Value) bool {
 	}
 }
 
+// Apply calls fn, which may be a function or a generic, with args.
+func Apply(fn Value, args []Value, c Context) Value {
+	var call func(*List, Context) Value
+	switch f := fn.(type) {
+	case Function:
+		call = f.Call
+	case *Generic:
+		call = f.Call
+	default:
+		return Atom{t: "error", value: fmt.Sprintf("Cannot call value of type '%s'", fn.Type())}
+	}
+	l := &List{children: args}
+	if h, ok := currentHook().(CallHook); ok {
+		h.EnterCall(fn, c)
+		v := call(l, c)
+		h.LeaveCall(fn, c, v)
+		return v
+	}
+	return call(l, c)
+}
+
+func isForm(l *List, name string) bool {
+	return !l.Quoted && len(l.children) > 0 && l.children[0].Type() == "identifier" && l.children[0].Value().(string) == name
+}
+
 func NestedReplace(n Value, subs *map[string]Value) []Value {
+	return nestedReplace(n, subs, Pos{})
+}
+
+// nestedReplace substitutes like NestedReplace, giving every list built from
+// the template the position pos of the macro call.
+func nestedReplace(n Value, subs *map[string]Value, pos Pos) []Value {
 	switch n.Type() {
 	case "identifier":
 		if v, ok := (*subs)[n.Value().(string)]; ok {
@@ -121,9 +157,9 @@ func NestedReplace(n Value, subs *map[string]Value) []Value {
 		}
 	case "list":
 		o := n.(*List)
-		l := &List{Quoted: o.Quoted}
+		l := &List{Quoted: o.Quoted, pos: pos}
 		for _, c := range o.children {
-			l.children = append(l.children, NestedReplace(c, subs)...)
+			l.children = append(l.children, nestedReplace(c, subs, pos)...)
 		}
 		return []Value{l}
 	}